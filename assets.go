@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var cssRefRe = regexp.MustCompile(`url\(\s*['"]?([^'")]+?)['"]?\s*\)|@import\s+['"]([^'"]+)['"]`)
+
+// cssReferences returns the url() and @import references in a stylesheet.
+func cssReferences(css string) []string {
+	var refs []string
+	for _, m := range cssRefRe.FindAllStringSubmatch(css, -1) {
+		if m[1] != "" {
+			refs = append(refs, m[1])
+		} else if m[2] != "" {
+			refs = append(refs, m[2])
+		}
+	}
+	return refs
+}
+
+// srcsetURLs returns the candidate URLs of a srcset attribute.
+func srcsetURLs(srcset string) []string {
+	var urls []string
+	for _, candidate := range strings.Split(srcset, ",") {
+		if fields := strings.Fields(candidate); len(fields) > 0 {
+			urls = append(urls, fields[0])
+		}
+	}
+	return urls
+}
+
+// isLocalRef reports whether ref points at a file in the site rather than
+// another origin, a data URI or an in-page fragment.
+func isLocalRef(ref string) bool {
+	if ref == "" || strings.HasPrefix(ref, "#") || strings.HasPrefix(ref, "//") {
+		return false
+	}
+	for _, prefix := range []string{"http", "data:", "mailto:", "tel:", "javascript:"} {
+		if strings.HasPrefix(ref, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// assetSet holds the local files referenced by the site, as slash-separated
+// paths relative to the site dir.
+type assetSet map[string]bool
+
+// add records ref, resolved against the URL path base, if it names an
+// existing file. Stylesheets are scanned for the files they reference in turn.
+func (a assetSet) add(dir, base, ref string) {
+	if !isLocalRef(ref) {
+		return
+	}
+	p, _, ok := resolveRoute(base, ref)
+	if !ok {
+		return
+	}
+	rel := strings.TrimPrefix(path.Clean(p), "/")
+	if rel == "" || rel == "." || strings.HasPrefix(rel, "../") || a[rel] {
+		return
+	}
+	file := filepath.Join(dir, filepath.FromSlash(rel))
+	info, err := os.Stat(file)
+	if err != nil || info.IsDir() {
+		return
+	}
+	a[rel] = true
+
+	if strings.EqualFold(path.Ext(rel), ".css") {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return
+		}
+		for _, nested := range cssReferences(string(data)) {
+			a.add(dir, "/"+rel, nested)
+		}
+	}
+}
+
+// copyAssets copies every asset from dir into outDir, skipping files whose
+// copy is already up to date. It returns the paths it wrote.
+// addUsedBy records the files the stylesheet css uses, but not css itself,
+// for a stylesheet that reaches the page bundled, inlined or purged.
+func (a assetSet) addUsedBy(dir, css string) {
+	used := make(assetSet)
+	used.add(dir, "/", css)
+	if p, _, ok := resolveRoute("/", css); ok {
+		delete(used, strings.TrimPrefix(path.Clean(p), "/"))
+	}
+	for rel := range used {
+		a[rel] = true
+	}
+}
+
+func copyAssets(dir, outDir string, assets assetSet) ([]string, error) {
+	var written []string
+	for rel := range assets {
+		src := filepath.Join(dir, filepath.FromSlash(rel))
+		dest := filepath.Join(outDir, filepath.FromSlash(rel))
+		copied, err := copyFileIfChanged(src, dest)
+		if err != nil {
+			return written, err
+		}
+		if copied {
+			written = append(written, dest)
+		}
+	}
+	return written, nil
+}
+
+func copyFileIfChanged(src, dest string) (bool, error) {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return false, err
+	}
+	if destInfo, err := os.Stat(dest); err == nil {
+		if destInfo.Size() == srcInfo.Size() && destInfo.ModTime().Equal(srcInfo.ModTime()) {
+			return false, nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return false, err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return false, err
+	}
+	if err := out.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Chtimes(dest, srcInfo.ModTime(), srcInfo.ModTime())
+}
+
+// resolveOutDir returns the directory the site is written to: the --out flag
+// if given, then the out key in pager.yaml, and otherwise the site dir itself.
+func resolveOutDir(dir string, cfg Config, override string) string {
+	out := cfg.Out
+	if override != "" {
+		out = override
+	}
+	if out == "" {
+		return filepath.Clean(dir)
+	}
+	if filepath.IsAbs(out) {
+		return filepath.Clean(out)
+	}
+	return filepath.Join(dir, out)
+}
+
+// isWithin reports whether path is dir or lies beneath it.
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -9,13 +9,19 @@ import (
 	"io"
 	"io/fs"
 	"log"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
-	htmltomd "github.com/JohannesKaufmann/html-to-markdown/v2"
+	"github.com/JohannesKaufmann/html-to-markdown/v2/converter"
+	"github.com/JohannesKaufmann/html-to-markdown/v2/plugin/base"
+	"github.com/JohannesKaufmann/html-to-markdown/v2/plugin/commonmark"
+	"golang.org/x/net/html"
 	"gopkg.in/yaml.v3"
 )
 
@@ -58,7 +64,10 @@ func hasGlobPattern(path string) bool {
 	return strings.ContainsAny(path, "*?[")
 }
 
-func expandCSSEntries(dir string, entries []string) []string {
+// expandEntries expands the globs in a css: or js: list, named by key, into
+// the files they match.
+func expandEntries(dir, key string, entries []string, report reporter) []string {
+	rule, kind := key+"-glob", strings.ToUpper(key)
 	var expanded []string
 	seen := make(map[string]bool)
 
@@ -78,11 +87,11 @@ func expandCSSEntries(dir string, entries []string) []string {
 
 		matches, err := filepath.Glob(filepath.Join(dir, entry))
 		if err != nil {
-			warn("invalid CSS glob pattern: %s", entry)
+			report(rule, "invalid %s glob pattern: %s", kind, entry)
 			continue
 		}
 		if len(matches) == 0 {
-			warn("CSS glob matched no files: %s", entry)
+			report(rule, "%s glob matched no files: %s", kind, entry)
 			continue
 		}
 
@@ -104,7 +113,7 @@ func expandCSSEntries(dir string, entries []string) []string {
 			added++
 		}
 		if added == 0 {
-			warn("CSS glob matched no files: %s", entry)
+			report(rule, "%s glob matched no files: %s", kind, entry)
 		}
 	}
 
@@ -124,125 +133,647 @@ func hashFile(path string) (string, error) {
 	return fmt.Sprintf("%x", h.Sum(nil))[:8], nil
 }
 
-func build(dir string) error {
-	return buildWithTailwindOutput(dir, "")
+// buildOptions carries command-line overrides into a build.
+type buildOptions struct {
+	tailwindOutput string // CSS compiled by the dev server's Tailwind watcher, if any
+	out            string // output directory from --out, overriding pager.yaml
+	format         string // diagnostics output: "" for the terminal, or "json"
+	strict         bool   // fail the build on any diagnostic, before writing anything
+	check          bool   // run every check but write nothing
+	external       bool   // also request every external URL the site uses
+	dev            bool   // building for the dev server: never minify
 }
 
-func buildWithTailwindOutput(dir, tailwindOutputPath string) error {
+// buildResult describes where a build wrote its files and what it reported.
+// It is returned even when the build fails.
+type buildResult struct {
+	outDir  string
+	written []string
+	diags   *diagnostics
+}
+
+func build(dir string, opts buildOptions) error {
+	_, err := buildSite(dir, opts)
+	return err
+}
+
+// pageBuild holds everything collected for one page between processing its
+// content and writing it out.
+type pageBuild struct {
+	page
+	cfg        Config
+	cssEntries []string
+	cssLinked  []string // local css: entries linked as they are, not bundled, inlined or purged
+	cssReport  reporter // reports at the page's css: setting
+	state      *processState
+	data       PageData
+	html       []byte // the rendered index.html, until it is written
+	markdown   []byte // the rendered index.md, or nil if it failed
+}
+
+// buildSite builds every page in the site into the output directory and
+// copies the local assets they reference alongside them.
+func buildSite(dir string, opts buildOptions) (*buildResult, error) {
 	perf := newBuildPerf()
 	defer perf.logSummary()
 
+	result := &buildResult{
+		outDir: filepath.Clean(dir),
+		diags:  newDiagnostics(opts.format == "json"),
+	}
+
 	stepStarted := time.Now()
 	raw, err := os.ReadFile(filepath.Join(dir, "pager.yaml"))
 	if err != nil {
-		return fmt.Errorf("pager.yaml: %w", err)
+		return result, fmt.Errorf("pager.yaml: %w", err)
 	}
 	var cfg Config
 	if err := yaml.Unmarshal(raw, &cfg); err != nil {
-		return fmt.Errorf("pager.yaml: %w", err)
+		return result, fmt.Errorf("pager.yaml: %w", err)
+	}
+	result.outDir = resolveOutDir(dir, cfg, opts.out)
+	diags := result.diags.withLint(cfg.Lint)
+	diags.checkLint(cfg.Lint, yamlKeyPositions(raw, "pager.yaml", 0)["lint"])
+	checkImages(cfg.Images, result.outDir == filepath.Clean(dir), diags.at(yamlKeyPositions(raw, "pager.yaml", 0)["images"]))
+	pages, err := discoverPages(dir, result.outDir)
+	if err != nil {
+		return result, err
 	}
-	cssEntries := expandCSSEntries(dir, cfg.CSS)
 	perf.mark("config", stepStarted)
 
+	// Tailwind CSS: compile from a synthetic entry and inline the output.
+	// The same stylesheet is shared by every page.
 	stepStarted = time.Now()
-	// Warn on missing essential frontmatter
-	if cfg.Title == "" {
-		warn("missing 'title' in pager.yaml")
+	var tailwindCSS []byte
+	if cfg.Tailwind {
+		out, err := readOrCompileTailwindCSS(dir, opts.tailwindOutput)
+		if err != nil {
+			if errors.Is(err, exec.ErrNotFound) {
+				diags.report("tailwind", position{File: "pager.yaml"}, "tailwindcss not found — install with: npm i -g @tailwindcss/cli or download the binary from https://github.com/tailwindlabs/tailwindcss/releases/tag/v4.2.0")
+			} else {
+				diags.report("tailwind", position{File: "pager.yaml"}, "tailwind failed: %v", err)
+			}
+		} else {
+			tailwindCSS = out
+		}
 	}
-	if cfg.Description == "" {
-		warn("missing 'description' in pager.yaml")
+	perf.mark("tailwind", stepStarted)
+
+	if cfg.PurgeCSS && !cfg.InlineCSS && result.outDir == filepath.Clean(dir) {
+		diags.report("purge-css", yamlKeyPositions(raw, "pager.yaml", 0)["purge_css"], "purge_css needs an out: directory (or inline_css) to purge linked stylesheets")
 	}
-	if cfg.Domain == "" {
-		warn("missing 'domain' in pager.yaml")
+
+	if cfg.CSP.Output == "headers" && result.outDir == filepath.Clean(dir) {
+		diags.report("csp", yamlKeyPositions(raw, "pager.yaml", 0)["csp"], "csp output: headers needs an out: directory; using a <meta> tag instead")
 	}
 
-	// Warn on title/description length
-	if len(cfg.Title) > 60 {
-		warn("title exceeds 60 characters (%d)", len(cfg.Title))
+	var manifest *assetManifest
+	if cfg.HashAssets {
+		if result.outDir == filepath.Clean(dir) {
+			diags.report("asset-hash", yamlKeyPositions(raw, "pager.yaml", 0)["hash_assets"], "hash_assets needs an out: directory; assets keep their names")
+		} else {
+			manifest = newAssetManifest(dir)
+		}
 	}
-	if len(cfg.Description) > 160 {
-		warn("description exceeds 160 characters (%d)", len(cfg.Description))
+
+	data, err := loadDataDir(dir)
+	if err != nil {
+		return result, err
 	}
 
+	site := &siteBuild{
+		dir:         dir,
+		outDir:      result.outDir,
+		opts:        opts,
+		raw:         raw,
+		tailwindCSS: tailwindCSS,
+		diags:       diags,
+		perf:        perf,
+		manifest:    manifest,
+		scripts:     make(map[string]*bundleFile),
+		styles:      make(map[string]*bundleFile),
+		images:      make(map[string]*imageVariant),
+		components:  loadComponents(dir, diags),
+		data:        data,
+	}
+	builds := make([]*pageBuild, 0, len(pages))
+	byRoute := make(map[string]*pageBuild, len(pages))
+	for _, p := range pages {
+		pb, err := site.preparePage(p)
+		if err != nil {
+			return result, err
+		}
+		builds = append(builds, pb)
+		byRoute[p.route] = pb
+	}
+	if site.sri != nil && !opts.check {
+		if err := site.sri.save(); err != nil {
+			diags.report("cache", position{File: sriCacheFile}, "could not save SRI cache: %v", err)
+		}
+	}
+
+	stepStarted = time.Now()
+	for _, pb := range builds {
+		checkLinks(pb, byRoute)
+	}
+	perf.mark("check_links", stepStarted)
+
+	if opts.external {
+		stepStarted = time.Now()
+		checker := newLinkChecker(dir, cfg.LinkCheck, diags.at(position{File: linkCacheFile}))
+		if err := checker.checkAll(externalRefs(dir, builds)); err != nil {
+			diags.report("cache", position{File: linkCacheFile}, "could not save link cache: %v", err)
+		}
+		perf.mark("check_external", stepStarted)
+	}
+
+	// Render every page, with its policy and index.md, before writing
+	// anything, so that --strict sees every diagnostic the build reports.
+	layouts := newLayouts(dir, diags)
+	var headerRoutes []string
+	policies := make(map[string]string)
+	for _, pb := range builds {
+		stepStarted = time.Now()
+		tmpl, err := layouts.get(pb.cfg.Template)
+		if err != nil {
+			return result, err
+		}
+		perf.mark("template_parse", stepStarted)
+
+		stepStarted = time.Now()
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, pb.data); err != nil {
+			if pb.cfg.Template == "" {
+				return result, fmt.Errorf("template: %w", err)
+			}
+			pos, msg := templateError(err, tmpl.Name(), 0)
+			return result, fmt.Errorf("%s: %s", pos, msg)
+		}
+		perf.mark("template_exec", stepStarted)
+
+		page := buf.Bytes()
+		if pb.cfg.Minify && !opts.dev {
+			stepStarted = time.Now()
+			page = minifyHTML(page)
+			perf.mark("minify_html", stepStarted)
+		}
+
+		// Content-Security-Policy: hash the page exactly as it is served
+		if csp := pb.cfg.CSP; (csp.Output == "meta" || csp.Output == "headers") && !opts.dev {
+			stepStarted = time.Now()
+			if csp.Output == "headers" && result.outDir == filepath.Clean(dir) {
+				csp.Output = "meta"
+			}
+			policy := pageCSP(page, csp).String()
+			if csp.Output == "headers" {
+				headerRoutes = append(headerRoutes, pb.route)
+				policies[pb.route] = policy
+			} else if withMeta, ok := insertCSPMeta(page, policy); ok {
+				page = withMeta
+			} else {
+				diags.at(position{File: pb.src})("csp", "page has no <head> to add the Content-Security-Policy to")
+			}
+			perf.mark("csp", stepStarted)
+		}
+		pb.html = page
+
+		stepStarted = time.Now()
+		pb.markdown = renderMarkdown(pb.cfg, pb.data.Content, diags.at(position{File: pb.src}))
+		perf.mark("render_markdown", stepStarted)
+	}
+
+	stepStarted = time.Now()
+	images := site.resizeImages()
+	perf.mark("resize_images", stepStarted)
+
+	if opts.strict {
+		if errs, warnings := diags.counts(); errs+warnings > 0 {
+			return result, fmt.Errorf("--strict: %s", diags.summary())
+		}
+	}
+	if opts.check {
+		return result, nil
+	}
+
+	for _, pb := range builds {
+		stepStarted = time.Now()
+		outDir := filepath.Join(result.outDir, pb.outputDir())
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			return result, err
+		}
+		htmlPath := filepath.Join(outDir, "index.html")
+		if err := os.WriteFile(htmlPath, pb.html, 0644); err != nil {
+			return result, err
+		}
+		result.written = append(result.written, htmlPath)
+		perf.mark("write_index_html", stepStarted)
+
+		if pb.markdown == nil {
+			continue
+		}
+		stepStarted = time.Now()
+		mdPath := filepath.Join(outDir, "index.md")
+		if err := os.WriteFile(mdPath, pb.markdown, 0644); err != nil {
+			return result, err
+		}
+		result.written = append(result.written, mdPath)
+		perf.mark("write_markdown", stepStarted)
+	}
+
+	stepStarted = time.Now()
+	bundled, err := site.writeBundles()
+	result.written = append(result.written, bundled...)
+	if err != nil {
+		return result, err
+	}
+	perf.mark("write_bundles", stepStarted)
+
+	stepStarted = time.Now()
+	resized, err := writeFiles(images)
+	result.written = append(result.written, resized...)
+	if err != nil {
+		return result, err
+	}
+	perf.mark("write_images", stepStarted)
+
+	// Copy referenced local assets when writing to a separate directory.
+	if result.outDir != filepath.Clean(dir) {
+		stepStarted = time.Now()
+		assets := make(assetSet)
+		linked := make(assetSet)
+		for _, pb := range builds {
+			for _, ref := range []string{pb.cfg.Favicon, pb.cfg.Card} {
+				assets.add(dir, "/", ref)
+			}
+			for _, css := range pb.cssEntries {
+				if slices.Contains(pb.cssLinked, css) || isRemoteAsset(css) {
+					assets.add(dir, "/", css)
+				} else {
+					assets.addUsedBy(dir, css)
+				}
+			}
+			for rel := range pb.state.assets {
+				assets[rel] = true
+			}
+			for rel := range pb.state.linked {
+				linked[rel] = true
+			}
+		}
+		var copied []string
+		if manifest != nil {
+			for rel := range assets {
+				manifest.name(rel)
+			}
+			copied, err = manifest.write(result.outDir)
+			if err == nil {
+				// Files the pages link to keep their names.
+				var plain []string
+				plain, err = copyAssets(dir, result.outDir, linked)
+				copied = append(copied, plain...)
+			}
+		} else {
+			maps.Copy(assets, linked)
+			copied, err = copyAssets(dir, result.outDir, assets)
+		}
+		result.written = append(result.written, copied...)
+		if err != nil {
+			return result, err
+		}
+		perf.mark("copy_assets", stepStarted)
+	}
+
+	if len(headerRoutes) > 0 {
+		headers, err := writeHeaders(dir, result.outDir, headerRoutes, policies)
+		if err != nil {
+			return result, err
+		}
+		result.written = append(result.written, headers)
+	}
+
+	return result, nil
+}
+
+// writeFiles writes files, keyed by path, creating their directories. It
+// returns the paths it wrote.
+func writeFiles(files map[string][]byte) ([]string, error) {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var written []string
+	for _, p := range paths {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return written, err
+		}
+		if err := os.WriteFile(p, files[p], 0644); err != nil {
+			return written, err
+		}
+		written = append(written, p)
+	}
+	return written, nil
+}
+
+// externalRefs gathers every external URL used by the pages and their
+// stylesheets, with a reporter for each place it is used.
+func externalRefs(dir string, builds []*pageBuild) map[string][]reporter {
+	refs := make(map[string][]reporter)
+	seenCSS := make(map[string]bool)
+	for _, pb := range builds {
+		for _, link := range pb.state.external {
+			refs[link.href] = append(refs[link.href], link.report)
+		}
+		for _, css := range pb.cssEntries {
+			if seenCSS[css] {
+				continue
+			}
+			seenCSS[css] = true
+			if isRemoteAsset(css) {
+				refs[css] = append(refs[css], pb.cssReport)
+				continue
+			}
+			for ref, pos := range cssExternalRefs(dir, css) {
+				refs[ref] = append(refs[ref], pb.state.diags.at(pos))
+			}
+		}
+	}
+	return refs
+}
+
+// siteBuild holds what every page in a build shares.
+type siteBuild struct {
+	dir         string
+	outDir      string
+	opts        buildOptions
+	raw         []byte // pager.yaml
+	tailwindCSS []byte
+	diags       *diagnostics
+	perf        *buildPerf
+	manifest    *assetManifest // nil unless assets get content-hashed names
+	scripts     map[string]*bundleFile
+	styles      map[string]*bundleFile
+	components  map[string]*component
+	data        map[string]any // the files in data/
+	sri         *sriCache      // loaded by the first page that asks for sri
+	images      map[string]*imageVariant
+}
+
+// assetLink links url, with its integrity hash if sri is set and url is
+// remote. Local files change with the site, so they are never pinned.
+func (site *siteBuild) assetLink(url string, sri bool, report reporter) assetLink {
+	if !sri || !isRemoteAsset(url) {
+		return assetLink{URL: url}
+	}
+	if site.sri == nil {
+		site.sri = loadSRICache(site.dir, site.diags.at(position{File: sriCacheFile}))
+	}
+	return assetLink{URL: url, Integrity: site.sri.integrity(url, report)}
+}
+
+// preparePage reads a page, applies its front matter to the shared config,
+// runs the config checks and processes its content.
+func (site *siteBuild) preparePage(p page) (*pageBuild, error) {
+	dir, diags, perf := site.dir, site.diags, site.perf
+	stepStarted := time.Now()
+	source, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(p.src)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.src, err)
+	}
+	front, content := splitFrontMatter(source)
+	cfg, err := loadPageConfig(site.raw, front, p.src)
+	if err != nil {
+		return nil, err
+	}
+	diags = diags.withLint(cfg.Lint)
+	// Config diagnostics point at the key in the page's front matter if it
+	// sets one, and at pager.yaml otherwise.
+	lineOffset := bytes.Count(source[:len(source)-len(content)], []byte("\n"))
+	yamlPos := yamlKeyPositions(site.raw, "pager.yaml", 0)
+	frontPos := yamlKeyPositions(front, p.src, 1)
+	at := func(key string) reporter {
+		if pos, ok := frontPos[key]; ok {
+			return diags.at(pos)
+		}
+		if pos, ok := yamlPos[key]; ok {
+			return diags.at(pos)
+		}
+		return diags.at(position{File: "pager.yaml"})
+	}
+	// pager.yaml's images: was checked once for the whole site, so only
+	// what the front matter sets itself is checked here.
+	if pos, ok := frontPos["images"]; ok {
+		var own struct {
+			Images ImagesConfig `yaml:"images"`
+		}
+		yaml.Unmarshal(front, &own)
+		checkImages(own.Images, site.outDir == filepath.Clean(dir), diags.at(pos))
+	}
+	if out := cfg.CSP.Output; out != "" && out != "meta" && out != "headers" {
+		at("csp")("csp", "unknown csp output %q: use meta or headers", out)
+	}
+	cssEntries := expandEntries(dir, "css", cfg.CSS, at("css"))
+	jsEntries := expandEntries(dir, "js", cfg.JS, at("js"))
+	perf.mark("read_html", stepStarted)
+
+	// Front matter in converted Markdown files fills in the title and
+	// description when the config leaves them empty. The page's own
+	// template sees the files it converts directly; partials are only
+	// expanded after it runs, so theirs are added once the content is
+	// processed.
+	mdFront := convertFrontMatter(dir, string(content))
+	applyFront := func() {
+		if title, ok := mdFront["title"].(string); ok && cfg.Title == "" {
+			cfg.Title = title
+		}
+		if description, ok := mdFront["description"].(string); ok && cfg.Description == "" {
+			cfg.Description = description
+		}
+	}
+	applyFront()
+
+	stepStarted = time.Now()
 	// Warn on missing referenced files
 	if cfg.Favicon == "" {
-		warn("missing 'favicon' in pager.yaml")
+		at("favicon")("meta-missing", "missing 'favicon' in pager.yaml")
 	} else if !isRemoteAsset(cfg.Favicon) {
 		if _, err := os.Stat(filepath.Join(dir, cfg.Favicon)); err != nil {
-			warn("favicon file not found: %s", cfg.Favicon)
+			at("favicon")("file-missing", "favicon file not found: %s", cfg.Favicon)
 		}
 	}
 	if cfg.Card == "" {
-		warn("missing 'card' in pager.yaml")
+		at("card")("meta-missing", "missing 'card' in pager.yaml")
 	} else if !isRemoteAsset(cfg.Card) {
 		if _, err := os.Stat(filepath.Join(dir, cfg.Card)); err != nil {
-			warn("card image not found: %s", cfg.Card)
+			at("card")("file-missing", "card image not found: %s", cfg.Card)
 		}
 	}
 	for _, css := range cssEntries {
 		if !isRemoteAsset(css) {
 			if _, err := os.Stat(filepath.Join(dir, css)); err != nil {
-				warn("CSS file not found: %s", css)
+				at("css")("file-missing", "CSS file not found: %s", css)
 			}
 		}
 	}
 	perf.mark("warnings", stepStarted)
 
 	stepStarted = time.Now()
-	content, err := os.ReadFile(filepath.Join(dir, "pager.html"))
+	state := newProcessState(dir, p, diags)
+	state.images = &imagePipeline{cfg: cfg.Images, dir: dir, outDir: site.outDir, hashed: site.manifest != nil, variants: site.images}
+	state.manifest = site.manifest
+	state.components = site.components
+	state.markdown = cfg.Markdown
+	annotated := annotatePositions(string(content), p.src, lineOffset)
+	annotated, err = executePageTemplate(annotated, p.src, lineOffset, pageTemplateData{
+		Config: cfg,
+		Data:   pageData(site.data, cfg.Data),
+		Front:  mdFront,
+		Route:  p.route,
+	})
 	if err != nil {
-		return fmt.Errorf("pager.html: %w", err)
+		return nil, err
 	}
-	perf.mark("read_html", stepStarted)
+	processed := processContent(annotated, state)
+	inject := state.processInject(cfg.Inject)
+	perf.mark("process_content", stepStarted)
 
-	// Tailwind CSS: compile from a synthetic entry and inline the output.
+	mdFront = state.front
+	applyFront()
+
+	// Warn on missing essential frontmatter
+	if cfg.Title == "" {
+		at("title")("meta-missing", "missing 'title' in pager.yaml")
+	}
+	if cfg.Description == "" {
+		at("description")("meta-missing", "missing 'description' in pager.yaml")
+	}
+	if cfg.Domain == "" {
+		at("domain")("meta-missing", "missing 'domain' in pager.yaml")
+	}
+
+	// Warn on title/description length
+	if len(cfg.Title) > 60 {
+		at("title")("meta-length", "title exceeds 60 characters (%d)", len(cfg.Title))
+	}
+	if len(cfg.Description) > 160 {
+		at("description")("meta-length", "description exceeds 160 characters (%d)", len(cfg.Description))
+	}
+
+	// Unused CSS: drop local rules that can't match this page. Linked
+	// stylesheets are swapped for purged copies, which needs a separate
+	// output directory. The dev server never purges, since classes come and
+	// go as you edit.
+	purging := cfg.PurgeCSS && !site.opts.dev
+	purgeLinked := purging && site.outDir != filepath.Clean(dir)
+	var purgedBefore, purgedAfter int
+	purge := func(css []byte) []byte { return css }
+	if purging {
+		used := pageSelectors(processed+inject, layoutSource(dir, cfg.Template), cfg.Safelist, at("purge_safelist"))
+		purge = func(css []byte) []byte {
+			purged := purgeCSS(string(css), used)
+			purgedBefore += len(css)
+			purgedAfter += len(purged)
+			return []byte(purged)
+		}
+	}
+
+	// Bundle the local stylesheets into one. The dev server keeps them
+	// separate, so they stay readable and edits don't litter the output.
 	stepStarted = time.Now()
-	var inlineStyles []template.CSS
-	if cfg.Tailwind {
-		out, err := readOrCompileTailwindCSS(dir, tailwindOutputPath)
-		if err != nil {
-			if errors.Is(err, exec.ErrNotFound) {
-				warn("tailwindcss not found — install with: npm i -g @tailwindcss/cli or download the binary from https://github.com/tailwindlabs/tailwindcss/releases/tag/v4.2.0")
-			} else {
-				warn("tailwind failed: %v", err)
+	var bundle *bundleFile
+	if cfg.BundleCSS && !site.opts.dev {
+		var local []string
+		for _, css := range cssEntries {
+			if isRemoteAsset(css) {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(dir, css)); err == nil {
+				local = append(local, css)
 			}
-		} else if len(out) > 0 {
-			inlineStyles = append(inlineStyles, template.CSS(out))
+		}
+		if len(local) > 0 {
+			bundle = site.bundleCSS(local, at("css"), diags)
+		}
+		if bundle != nil && (purging && cfg.InlineCSS || purgeLinked) {
+			bundle = site.purgedStylesheet("bundle.css", purge(bundle.code))
 		}
 	}
-	perf.mark("tailwind", stepStarted)
+	perf.mark("bundle_css", stepStarted)
+
+	var inlineStyles []template.CSS
+	if len(site.tailwindCSS) > 0 {
+		inlineStyles = append(inlineStyles, template.CSS(site.tailwindCSS))
+	}
 
 	// Inline CSS: read file contents into <style> tags instead of <link>
 	stepStarted = time.Now()
-	if cfg.InlineCSS {
+	if cfg.InlineCSS && bundle != nil {
+		inlineStyles = append(inlineStyles, template.CSS(bundle.code))
+	} else if cfg.InlineCSS {
 		for _, css := range cssEntries {
 			if isRemoteAsset(css) {
 				continue
 			}
 			data, err := os.ReadFile(filepath.Join(dir, css))
 			if err != nil {
-				warn("could not read CSS for inlining: %s", css)
+				at("css")("css-read", "could not read CSS for inlining: %s", css)
 				continue
 			}
-			inlineStyles = append(inlineStyles, template.CSS(data))
+			if site.manifest != nil {
+				data = []byte(site.manifest.rewriteCSS("/"+strings.TrimPrefix(css, "/"), string(data)))
+			}
+			inlineStyles = append(inlineStyles, template.CSS(purge(data)))
 		}
 	}
 	perf.mark("inline_css", stepStarted)
 
 	// Build <link> refs: exclude local files when inlining
 	stepStarted = time.Now()
-	var cssRefs []string
+	var cssRefs, cssLinked []string
 	for _, css := range cssEntries {
-		if cfg.InlineCSS && !isRemoteAsset(css) {
+		if isRemoteAsset(css) {
+			cssRefs = append(cssRefs, css)
+			continue
+		}
+		if cfg.InlineCSS {
 			continue
 		}
+		if bundle != nil {
+			// The bundle takes the place of the first local stylesheet.
+			if !slices.Contains(cssRefs, bundle.url) {
+				cssRefs = append(cssRefs, bundle.url)
+				bundle.linked = true
+			}
+			continue
+		}
+		if purgeLinked {
+			// Link a purged copy, named after its content like a bundle.
+			data, err := os.ReadFile(filepath.Join(dir, css))
+			if err == nil {
+				if site.manifest != nil {
+					data = []byte(site.manifest.rewriteCSS("/"+strings.TrimPrefix(css, "/"), string(data)))
+				}
+				purged := site.purgedStylesheet(css, purge(data))
+				purged.linked = true
+				cssRefs = append(cssRefs, purged.url)
+				continue
+			}
+		}
 		cssRefs = append(cssRefs, css)
+		cssLinked = append(cssLinked, css)
+	}
+	if purgedBefore > 0 && !site.opts.check {
+		diags.at(position{File: p.src})("purge-css-saved", "purged unused CSS: %s of %s removed (%d%%)", formatBytes(purgedBefore-purgedAfter), formatBytes(purgedBefore), (purgedBefore-purgedAfter)*100/purgedBefore)
 	}
 	perf.mark("css_refs", stepStarted)
 
-	// Cache-busting: append content hash as query string
+	// Cache-busting: point at the content-hashed copy, or append the
+	// content hash as a query string when files keep their names
 	stepStarted = time.Now()
-	{
+	if site.manifest != nil {
+		for i, css := range cssRefs {
+			cssRefs[i] = site.manifest.ref("/", css)
+		}
+	} else {
 		var versioned []string
 		for _, css := range cssRefs {
 			if isRemoteAsset(css) {
@@ -260,6 +791,14 @@ func buildWithTailwindOutput(dir, tailwindOutputPath string) error {
 	}
 	perf.mark("hash_css_refs", stepStarted)
 
+	// Subresource Integrity: pin the hash of every remote stylesheet
+	stepStarted = time.Now()
+	var cssLinks []assetLink
+	for _, css := range cssRefs {
+		cssLinks = append(cssLinks, site.assetLink(css, cfg.SRI, at("css")))
+	}
+	perf.mark("sri", stepStarted)
+
 	// Syntax theme: inline chroma CSS if theme is set
 	// Supports "light" or "light/dark" format (e.g. "github" or "github/monokai")
 	stepStarted = time.Now()
@@ -267,20 +806,20 @@ func buildWithTailwindOutput(dir, tailwindOutputPath string) error {
 		if parts := strings.SplitN(cfg.Theme, "/", 2); len(parts) == 2 {
 			lightCSS := syntaxThemeCSS(parts[0])
 			if lightCSS == "" {
-				warn("unknown light syntax theme: %s", parts[0])
+				at("theme")("theme-unknown", "unknown light syntax theme: %s", parts[0])
 			} else {
 				inlineStyles = append(inlineStyles, template.CSS(lightCSS))
 			}
 			darkCSS := syntaxThemeDarkCSS(parts[1])
 			if darkCSS == "" {
-				warn("unknown dark syntax theme: %s", parts[1])
+				at("theme")("theme-unknown", "unknown dark syntax theme: %s", parts[1])
 			} else {
 				inlineStyles = append(inlineStyles, template.CSS(darkCSS))
 			}
 		} else {
 			css := syntaxThemeCSS(cfg.Theme)
 			if css == "" {
-				warn("unknown syntax theme: %s", cfg.Theme)
+				at("theme")("theme-unknown", "unknown syntax theme: %s", cfg.Theme)
 			} else {
 				inlineStyles = append(inlineStyles, template.CSS(css))
 			}
@@ -288,53 +827,63 @@ func buildWithTailwindOutput(dir, tailwindOutputPath string) error {
 	}
 	perf.mark("syntax_theme", stepStarted)
 
+	// Alerts come with a default look, which any rule of the site's own
+	// overrides.
+	if cfg.Markdown.Alerts && strings.Contains(processed, `<aside class="alert alert-`) {
+		inlineStyles = append(inlineStyles, template.CSS(alertCSS))
+	}
+
+	// Scripts: bundle local entries with esbuild, then link or inline them
 	stepStarted = time.Now()
-	processedContent := template.HTML(processContent(string(content), dir))
-	perf.mark("process_content", stepStarted)
+	var scripts []assetLink
+	var inlineScripts []template.JS
+	for _, entry := range jsEntries {
+		if isRemoteAsset(entry) {
+			// Remote scripts run as classic scripts unless asked otherwise:
+			// as modules they'd be deferred, strict and without globals.
+			link := site.assetLink(entry, cfg.SRI, at("js"))
+			link.Module = cfg.ModuleJS
+			scripts = append(scripts, link)
+			continue
+		}
+		bundle := site.bundleJS(entry, cfg.Minify && !site.opts.dev, at("js"), diags)
+		if bundle == nil {
+			continue
+		}
+		if cfg.InlineJS {
+			inlineScripts = append(inlineScripts, template.JS(bundle.code))
+			continue
+		}
+		bundle.linked = true
+		scripts = append(scripts, assetLink{URL: bundle.url, Module: true})
+	}
+	perf.mark("bundle_js", stepStarted)
 
 	data := PageData{
-		Title:        cfg.Title,
-		Description:  cfg.Description,
-		Favicon:      cfg.Favicon,
-		Card:         cfg.Card,
-		CSS:          cssRefs,
-		InlineStyles: inlineStyles,
-		Inject:       template.HTML(cfg.Inject),
-		Content:      processedContent,
+		Title:         cfg.Title,
+		Description:   cfg.Description,
+		Favicon:       site.manifest.ref("/", cfg.Favicon),
+		Card:          site.manifest.ref("/", cfg.Card),
+		Route:         p.route,
+		CSS:           cssLinks,
+		InlineStyles:  inlineStyles,
+		Scripts:       scripts,
+		InlineScripts: inlineScripts,
+		Front:         mdFront,
+		Inject:        template.HTML(inject),
+		Content:       template.HTML(processed),
 	}
 	domain := cfg.Domain
 	if domain != "" && !strings.HasPrefix(domain, "http://") && !strings.HasPrefix(domain, "https://") {
 		domain = "https://" + domain
 	}
 	data.Site.Domain = domain
-
-	stepStarted = time.Now()
-	tmpl, err := template.New("page").Parse(templateHTML)
-	if err != nil {
-		return fmt.Errorf("template: %w", err)
+	data.URL = domain
+	if p.route != "/" {
+		data.URL = domain + p.route
 	}
-	perf.mark("template_parse", stepStarted)
 
-	stepStarted = time.Now()
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, data); err != nil {
-		return fmt.Errorf("template: %w", err)
-	}
-	perf.mark("template_exec", stepStarted)
-
-	stepStarted = time.Now()
-	if err := os.WriteFile(filepath.Join(dir, "index.html"), buf.Bytes(), 0644); err != nil {
-		return err
-	}
-	perf.mark("write_index_html", stepStarted)
-
-	stepStarted = time.Now()
-	if err := writeMarkdownFile(dir, cfg, data.Content); err != nil {
-		return err
-	}
-	perf.mark("write_markdown", stepStarted)
-
-	return nil
+	return &pageBuild{page: p, cfg: cfg, cssEntries: cssEntries, cssLinked: cssLinked, cssReport: at("css"), state: state, data: data}, nil
 }
 
 func readOrCompileTailwindCSS(dir, tailwindOutputPath string) ([]byte, error) {
@@ -376,23 +925,68 @@ func compileTailwindFromSyntheticInput(dir string) ([]byte, error) {
 	return out, err
 }
 
-func writeMarkdownFile(dir string, cfg Config, content template.HTML) error {
-	md, err := htmltomd.ConvertString(string(content))
+// renderMarkdown renders the index.md for a page, or returns nil and
+// reports it when the page can't be converted.
+func renderMarkdown(cfg Config, content template.HTML, report reporter) []byte {
+	conv := converter.NewConverter(
+		converter.WithPlugins(base.NewBasePlugin(), commonmark.NewCommonmarkPlugin()),
+	)
+	sources := make(markdownSources)
+	conv.Register.PreRenderer(sources.collect, 0)
+	conv.Register.Renderer(sources.render, converter.PriorityEarly)
+	md, err := conv.ConvertString(string(content))
 	if err != nil {
-		warn("failed to generate index.md: %v", err)
+		report("markdown-output", "failed to generate index.md: %v", err)
 		return nil
 	}
 
 	header := fmt.Sprintf("<!-- THIS FILE IS AUTO-GENERATED FROM INDEX.HTML -->\n---\ntitle: %q\ndescription: %q\ndomain: %q\n---\n\n", cfg.Title, cfg.Description, cfg.Domain)
-	if err := os.WriteFile(filepath.Join(dir, "index.md"), []byte(header+md), 0644); err != nil {
-		return err
+	return []byte(header + md)
+}
+
+// markdownSources writes math and diagrams into index.md as the TeX or
+// ASCII art they were written in. The sources are read before the
+// converter collapses their white space.
+type markdownSources map[*html.Node]string
+
+func (m markdownSources) collect(ctx converter.Context, doc *html.Node) {
+	if doc.Type == html.ElementNode {
+		var source string
+		var ok bool
+		switch doc.Data {
+		case "math":
+			source, ok = mathTeX(doc)
+		case "svg":
+			source, ok = diagramSource(doc)
+		}
+		if ok {
+			m[doc] = source
+			return
+		}
+	}
+	for c := doc.FirstChild; c != nil; c = c.NextSibling {
+		m.collect(ctx, c)
 	}
+}
 
-	return nil
+func (m markdownSources) render(ctx converter.Context, w converter.Writer, n *html.Node) converter.RenderStatus {
+	source, ok := m[n]
+	if !ok {
+		return converter.RenderTryNext
+	}
+	switch {
+	case n.Data == "svg":
+		_, _ = w.WriteString("\n\n```\n" + source + "\n```\n\n")
+	case getAttr(n, "display") == "block":
+		_, _ = w.WriteString("\n\n$$\n" + source + "\n$$\n\n")
+	default:
+		_, _ = w.WriteString("$" + source + "$")
+	}
+	return converter.RenderSuccess
 }
 
-func deploy(dir string) error {
-	if err := build(dir); err != nil {
+func deploy(dir string, opts buildOptions) error {
+	if err := build(dir, opts); err != nil {
 		return err
 	}
 	log.Printf("Built index.html")
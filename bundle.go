@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// bundleFile is a script or stylesheet bundled with everything it imports.
+type bundleFile struct {
+	code   []byte
+	out    string // path of the bundle relative to the output dir
+	url    string // what pages link to
+	linked bool   // some page links the bundle rather than inlining it
+}
+
+// reportESBuild reports an esbuild message at its source location, or at
+// the setting that asked for the bundle when it has none.
+func reportESBuild(diags *diagnostics, report reporter, rule string, msg api.Message) {
+	if msg.Location == nil || msg.Location.File == "<stdin>" {
+		report(rule, "%s", msg.Text)
+		return
+	}
+	pos := position{
+		File: filepath.ToSlash(msg.Location.File),
+		Line: msg.Location.Line,
+		Col:  msg.Location.Column + 1,
+	}
+	diags.at(pos)(rule, "%s", msg.Text)
+}
+
+// staleBundleRe matches the names bundleCSS gives its stylesheets.
+var staleBundleRe = regexp.MustCompile(`^bundle\.[0-9a-f]{8}\.css$`)
+
+// writeBundles writes every linked bundle into outDir, skipping files that
+// are already up to date, and removes the CSS bundles earlier builds left
+// there that no page links any more: every change to the stylesheets names a
+// new one. It returns the paths it wrote.
+func (site *siteBuild) writeBundles() ([]string, error) {
+	var written []string
+	var bundles []*bundleFile
+	for _, b := range site.scripts {
+		bundles = append(bundles, b)
+	}
+	for _, b := range site.styles {
+		bundles = append(bundles, b)
+	}
+	for _, b := range bundles {
+		if b == nil || !b.linked {
+			continue
+		}
+		dest := filepath.Join(site.outDir, filepath.FromSlash(b.out))
+		if existing, err := os.ReadFile(dest); err == nil && bytes.Equal(existing, b.code) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return written, err
+		}
+		if err := os.WriteFile(dest, b.code, 0644); err != nil {
+			return written, err
+		}
+		written = append(written, dest)
+	}
+
+	current := make(map[string]bool)
+	for _, b := range site.styles {
+		if b != nil && b.linked {
+			current[b.out] = true
+		}
+	}
+	entries, _ := os.ReadDir(site.outDir)
+	for _, e := range entries {
+		if e.Type().IsRegular() && staleBundleRe.MatchString(e.Name()) && !current[e.Name()] {
+			if err := os.Remove(filepath.Join(site.outDir, e.Name())); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBundleCSS(t *testing.T) {
+	dir := t.TempDir()
+	for name, css := range map[string]string{
+		"base.css":       "@import \"/parts/type.css\";\nbody { margin: 0 }\n",
+		"parts/type.css": "h1 { font: bold 2em serif }\n",
+		"theme.css":      ".card { background: url(img/bg.png) }\n",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(css), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var r reports
+	site := &siteBuild{dir: dir, styles: make(map[string]*bundleFile), diags: newDiagnostics(true)}
+	b := site.bundleCSS([]string{"base.css", "theme.css"}, r.reporter(), site.diags)
+	if b == nil {
+		t.Fatalf("no bundle, reports %q", r.got)
+	}
+	code := string(b.code)
+	for _, want := range []string{"h1{", "body{margin:0}", "url(/img/bg.png)"} {
+		if !strings.Contains(code, want) {
+			t.Errorf("bundle %q lacks %q", code, want)
+		}
+	}
+	if i, j := strings.Index(code, "h1{"), strings.Index(code, "body{"); i > j {
+		t.Errorf("bundle %q doesn't keep the import before the rules after it", code)
+	}
+	if !staleBundleRe.MatchString(b.out) || b.url != "/"+b.out {
+		t.Errorf("bundle named %q at %q", b.out, b.url)
+	}
+	if again := site.bundleCSS([]string{"base.css", "theme.css"}, r.reporter(), site.diags); again != b {
+		t.Errorf("the same stylesheets were bundled twice")
+	}
+}
+
+func TestWriteBundlesRemovesStale(t *testing.T) {
+	out := t.TempDir()
+	for _, name := range []string{"bundle.0123abcd.css", "bundle.css", "bundle.0123abcd.js", "style.0123abcd.css"} {
+		if err := os.WriteFile(filepath.Join(out, name), []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	site := &siteBuild{
+		outDir: out,
+		styles: map[string]*bundleFile{
+			"a.css": {code: []byte("a{}"), out: "bundle.89abcdef.css", linked: true},
+			"b.css": {code: []byte("b{}"), out: "bundle.fedcba98.css"}, // inlined
+		},
+	}
+	written, err := site.writeBundles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(out, "bundle.89abcdef.css")}; !slices.Equal(written, want) {
+		t.Errorf("wrote %q, want %q", written, want)
+	}
+	entries, err := os.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	// Only the bundle no page links any more goes; files that merely look
+	// similar stay.
+	if want := []string{"bundle.0123abcd.js", "bundle.89abcdef.css", "bundle.css", "style.0123abcd.css"}; !slices.Equal(names, want) {
+		t.Errorf("output has %q, want %q", names, want)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"gopkg.in/yaml.v3"
+)
+
+// componentsDir holds the templates for x-* elements, one per file:
+// components/x-card.html expands <x-card>.
+const componentsDir = "components"
+
+// component is a parsed components/x-*.html template. Its front matter may
+// list the attributes every use of it must set.
+type component struct {
+	file     string
+	tmpl     *template.Template
+	required []string
+}
+
+var (
+	templateErrRe    = regexp.MustCompile(`(?s)^(?:html/)?template: ?(.+?):(\d+):(?:(\d+):)? (.*)$`)
+	componentCloseRe = regexp.MustCompile(`<(x-[\w-]+)\b([^>]*?)\s*/>`)
+)
+
+// loadComponents parses every template in the site's components directory,
+// keyed by the tag it expands. Templates that fail to parse are reported
+// and left out.
+func loadComponents(dir string, diags *diagnostics) map[string]*component {
+	components := make(map[string]*component)
+	files, _ := filepath.Glob(filepath.Join(dir, componentsDir, "x-*.html"))
+	for _, file := range files {
+		rel := path.Join(componentsDir, filepath.Base(file))
+		source, err := os.ReadFile(file)
+		if err != nil {
+			diags.report("component", position{File: rel}, "%v", err)
+			continue
+		}
+		front, body := splitFrontMatter(source)
+		lineOffset := bytes.Count(source[:len(source)-len(body)], []byte("\n"))
+		var meta struct {
+			Required []string `yaml:"required"`
+		}
+		if err := yaml.Unmarshal(front, &meta); err != nil {
+			diags.report("component", position{File: rel, Line: 2}, "front matter: %v", err)
+			continue
+		}
+		// Positions point into the template source; columns are skipped
+		// since annotating shifts them.
+		tmpl, err := template.New(rel).Parse(annotatePositions(string(body), rel, lineOffset))
+		if err != nil {
+			pos, msg := templateError(err, rel, 0)
+			pos.Col = 0
+			diags.report("component", pos, "%s", msg)
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(file), ".html")
+		components[name] = &component{file: rel, tmpl: tmpl, required: meta.Required}
+	}
+	return components
+}
+
+// templateError splits a text/template or html/template error about file
+// into the position it names and the rest of its message. lineOffset is
+// added to the line, for templates that don't start at the top of file.
+func templateError(err error, file string, lineOffset int) (position, string) {
+	m := templateErrRe.FindStringSubmatch(err.Error())
+	if m == nil || m[1] != file {
+		return position{File: file}, err.Error()
+	}
+	line, _ := strconv.Atoi(m[2])
+	col, _ := strconv.Atoi(m[3])
+	return position{File: file, Line: line + lineOffset, Col: col}, m[4]
+}
+
+// closeComponentTags rewrites self-closing <x-icon /> tags as <x-icon></x-icon>,
+// since HTML would otherwise treat everything after them as their content.
+func closeComponentTags(content string) string {
+	return componentCloseRe.ReplaceAllString(content, "<$1$2></$1>")
+}
+
+// expandComponents replaces every x-* element under parent with its
+// component's output. stack holds the components being expanded, to catch
+// ones that end up using themselves, and ignored the pager-ignore comments
+// around each element, as found by ignoredByTag.
+func (s *processState) expandComponents(parent *html.Node, stack []string, ignored map[string][]map[string]bool) {
+	for c := parent.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.ElementNode && strings.HasPrefix(c.Data, "x-") {
+			s.expandComponent(c, stack, ignored)
+		} else {
+			s.expandComponents(c, stack, ignored)
+		}
+		c = next
+	}
+}
+
+// expandComponent renders n's component with n's attributes and, as .Body,
+// its already-expanded content, and puts the result in n's place.
+func (s *processState) expandComponent(n *html.Node, stack []string, ignored map[string][]map[string]bool) {
+	key := getAttr(n, posAttr)
+	pos, _ := takePos(n)
+	report := s.reporterAt(pos, ignored[key])
+	comp, ok := s.components[n.Data]
+	if !ok {
+		report("component-unknown", "<%s> has no template at %s/%s.html", n.Data, componentsDir, n.Data)
+		s.expandComponents(n, stack, ignored)
+		return
+	}
+	parent := n.Parent
+	if slices.Contains(stack, n.Data) {
+		report("component-cycle", "<%s> uses itself: %s", n.Data, strings.Join(append(slices.Clone(stack), n.Data), " → "))
+		parent.RemoveChild(n)
+		return
+	}
+
+	data := make(map[string]any, len(n.Attr)+1)
+	for _, a := range n.Attr {
+		data[a.Key] = a.Val
+	}
+	for _, name := range comp.required {
+		if _, ok := data[name]; !ok {
+			report("component-attr", "<%s> is missing required attribute %q", n.Data, name)
+		}
+	}
+	s.expandComponents(n, stack, ignored)
+	var body bytes.Buffer
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		html.Render(&body, c)
+	}
+	data["Body"] = template.HTML(body.String())
+
+	var out bytes.Buffer
+	if err := comp.tmpl.Execute(&out, data); err != nil {
+		tmplPos, msg := templateError(err, comp.file, 0)
+		tmplPos.Col = 0
+		s.reporterAt(tmplPos, ignored[key])("component", "<%s> at %s: %s", n.Data, pos, msg)
+		parent.RemoveChild(n)
+		return
+	}
+	nodes, err := html.ParseFragment(strings.NewReader(closeComponentTags(out.String())), parent)
+	if err != nil {
+		report("component", "<%s> output could not be parsed: %v", n.Data, err)
+		parent.RemoveChild(n)
+		return
+	}
+	inner := append(slices.Clone(stack), n.Data)
+	for _, c := range nodes {
+		parent.InsertBefore(c, n)
+	}
+	parent.RemoveChild(n)
+	for _, c := range nodes {
+		if c.Type == html.ElementNode && strings.HasPrefix(c.Data, "x-") {
+			s.expandComponent(c, inner, ignored)
+		} else {
+			s.expandComponents(c, inner, ignored)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"maps"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// CSPConfig turns on a generated Content-Security-Policy for every page.
+type CSPConfig struct {
+	// Output is "meta" for a <meta http-equiv> tag in each page, or
+	// "headers" for a _headers file in the output directory.
+	Output string `yaml:"output"`
+	// Sources adds sources the pages can't reveal, such as the font host
+	// of a remote stylesheet, keyed by directive.
+	Sources map[string][]string `yaml:"sources"`
+}
+
+// cspDirectives is the order directives are written in. Those past
+// script-src and style-src are only written when they allow more than
+// default-src does.
+var cspDirectives = []string{
+	"default-src", "script-src", "style-src", "img-src", "font-src", "media-src",
+	"frame-src", "connect-src", "object-src", "base-uri", "form-action", "frame-ancestors",
+}
+
+var cspDefaults = map[string][]string{
+	"default-src": {"'self'"},
+	"script-src":  {"'self'"},
+	"style-src":   {"'self'"},
+	"object-src":  {"'none'"},
+	"base-uri":    {"'self'"},
+	"form-action": {"'self'"},
+}
+
+// cspPolicy collects the sources each directive needs, in the order they
+// were found.
+type cspPolicy map[string][]string
+
+func (p cspPolicy) add(directive string, sources ...string) {
+	for _, src := range sources {
+		if src == "" || slices.Contains(p[directive], src) {
+			continue
+		}
+		switch _, ok := p[directive]; {
+		case !ok && strings.HasSuffix(directive, "-src"):
+			// A fetch directive replaces default-src, so keep what it allowed.
+			p[directive] = []string{"'self'"}
+		case len(p[directive]) == 1 && p[directive][0] == "'none'":
+			// A directive that allowed nothing allows just what's added.
+			p[directive] = nil
+		}
+		if slices.Contains(p[directive], src) {
+			continue
+		}
+		p[directive] = append(p[directive], src)
+	}
+}
+
+func (p cspPolicy) String() string {
+	var parts []string
+	for _, d := range cspDirectives {
+		sources, ok := p[d]
+		if !ok {
+			continue
+		}
+		if _, always := cspDefaults[d]; !always && d != "frame-ancestors" && len(sources) == 1 && sources[0] == "'self'" {
+			continue
+		}
+		parts = append(parts, d+" "+strings.Join(sources, " "))
+	}
+	for _, d := range slices.Sorted(maps.Keys(p)) {
+		if !slices.Contains(cspDirectives, d) {
+			parts = append(parts, d+" "+strings.Join(p[d], " "))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// pageCSP computes the policy for a built page: a hash for every inline
+// <style> and <script>, and for style and event handler attributes, plus
+// the origin of every remote file the page loads. It must see the page
+// exactly as it is served, so it runs after minification.
+func pageCSP(page []byte, cfg CSPConfig) cspPolicy {
+	p := make(cspPolicy)
+	for d, sources := range cspDefaults {
+		p[d] = slices.Clone(sources)
+	}
+	if cfg.Output == "headers" {
+		// Only honoured as a header, not in a <meta> tag.
+		p.add("frame-ancestors", "'self'")
+	}
+
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		return p
+	}
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			cspElement(p, n)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	for _, d := range slices.Sorted(maps.Keys(cfg.Sources)) {
+		p.add(d, cfg.Sources[d]...)
+	}
+	return p
+}
+
+// cspElement adds what a single element needs to p.
+func cspElement(p cspPolicy, n *html.Node) {
+	for _, a := range n.Attr {
+		switch {
+		case a.Key == "style" && strings.TrimSpace(a.Val) != "":
+			p.add("style-src", "'unsafe-hashes'", cspHash(a.Val))
+			cspCSSRefs(p, a.Val)
+		case strings.HasPrefix(a.Key, "on") && a.Val != "":
+			p.add("script-src", "'unsafe-hashes'", cspHash(a.Val))
+		}
+	}
+
+	switch n.Data {
+	case "style":
+		text := textContent(n)
+		p.add("style-src", cspHash(text))
+		cspCSSRefs(p, text)
+	case "script":
+		if src := getAttr(n, "src"); src != "" {
+			p.add("script-src", cspSource(src))
+			return
+		}
+		switch strings.ToLower(getAttr(n, "type")) {
+		case "", "module", "text/javascript", "application/javascript":
+			p.add("script-src", cspHash(textContent(n)))
+		}
+	case "link":
+		href := getAttr(n, "href")
+		rel := strings.Fields(strings.ToLower(getAttr(n, "rel")))
+		switch {
+		case slices.Contains(rel, "stylesheet"):
+			p.add("style-src", cspSource(href))
+		case slices.Contains(rel, "modulepreload"):
+			p.add("script-src", cspSource(href))
+		case slices.Contains(rel, "preload"):
+			if d, ok := map[string]string{"script": "script-src", "style": "style-src", "image": "img-src", "font": "font-src", "fetch": "connect-src"}[getAttr(n, "as")]; ok {
+				p.add(d, cspSource(href))
+			}
+		case slices.Contains(rel, "icon") || slices.Contains(rel, "apple-touch-icon"):
+			p.add("img-src", cspSource(href))
+		}
+	case "img":
+		p.add("img-src", cspSource(getAttr(n, "src")))
+		p.add("img-src", cspSrcset(getAttr(n, "srcset"))...)
+	case "source":
+		p.add("img-src", cspSrcset(getAttr(n, "srcset"))...)
+		p.add("media-src", cspSource(getAttr(n, "src")))
+	case "video", "audio", "track":
+		p.add("media-src", cspSource(getAttr(n, "src")))
+		p.add("img-src", cspSource(getAttr(n, "poster")))
+	case "iframe":
+		p.add("frame-src", cspSource(getAttr(n, "src")))
+	case "form":
+		p.add("form-action", cspSource(getAttr(n, "action")))
+	}
+}
+
+// cspCSSRefs adds the sources a stylesheet's url()s and @imports load.
+func cspCSSRefs(p cspPolicy, css string) {
+	for _, m := range cssRefRe.FindAllStringSubmatch(css, -1) {
+		if m[2] != "" {
+			p.add("style-src", cspSource(m[2]))
+			continue
+		}
+		switch strings.ToLower(path.Ext(strings.SplitN(m[1], "?", 2)[0])) {
+		case ".woff2", ".woff", ".ttf", ".otf", ".eot":
+			p.add("font-src", cspSource(m[1]))
+		default:
+			p.add("img-src", cspSource(m[1]))
+		}
+	}
+}
+
+func cspSrcset(srcset string) []string {
+	var sources []string
+	for _, candidate := range strings.Split(srcset, ",") {
+		if fields := strings.Fields(candidate); len(fields) > 0 {
+			sources = append(sources, cspSource(fields[0]))
+		}
+	}
+	return sources
+}
+
+// cspSource returns the source expression allowing ref to load: its origin
+// if it is remote, its scheme for data: and blob: URLs, and 'self' for
+// everything else.
+func cspSource(ref string) string {
+	ref = strings.TrimSpace(ref)
+	switch {
+	case ref == "":
+		return ""
+	case strings.HasPrefix(ref, "data:"):
+		return "data:"
+	case strings.HasPrefix(ref, "blob:"):
+		return "blob:"
+	case strings.HasPrefix(ref, "//"):
+		if u, err := url.Parse(ref); err == nil && u.Host != "" {
+			return u.Host
+		}
+		return ""
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return u.Scheme + "://" + u.Host
+	}
+	if u.Scheme != "" {
+		return ""
+	}
+	return "'self'"
+}
+
+func cspHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'"
+}
+
+// insertCSPMeta adds the policy to the page as a <meta http-equiv> tag at the
+// start of <head>, before anything it governs. It reports false if the
+// page has no <head> tag.
+func insertCSPMeta(page []byte, policy string) ([]byte, bool) {
+	z := html.NewTokenizer(bytes.NewReader(page))
+	offset := 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return page, false
+		}
+		offset += len(z.Raw())
+		if tt != html.StartTagToken {
+			continue
+		}
+		if name, _ := z.TagName(); string(name) == "head" {
+			break
+		}
+	}
+	meta := `<meta http-equiv="Content-Security-Policy" content="` + strings.NewReplacer("&", "&amp;", `"`, "&quot;").Replace(policy) + `">`
+	return slices.Concat(page[:offset], []byte(meta), page[offset:]), true
+}
+
+// writeHeaders writes a _headers file giving every page its policy, after
+// whatever the site's own _headers file says.
+func writeHeaders(dir, outDir string, routes []string, policies map[string]string) (string, error) {
+	var sb strings.Builder
+	if own, err := os.ReadFile(filepath.Join(dir, "_headers")); err == nil {
+		sb.Write(own)
+		if len(own) > 0 && own[len(own)-1] != '\n' {
+			sb.WriteByte('\n')
+		}
+	}
+	for _, route := range routes {
+		sb.WriteString(route + "\n  Content-Security-Policy: " + policies[route] + "\n")
+	}
+	out := filepath.Join(outDir, "_headers")
+	return out, os.WriteFile(out, []byte(sb.String()), 0644)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCSPSource(t *testing.T) {
+	for _, tt := range []struct {
+		ref, want string
+	}{
+		{"/style.css", "'self'"},
+		{"img/a.png", "'self'"},
+		{"https://cdn.example.com/a.js?v=1", "https://cdn.example.com"},
+		{"http://example.com:8080/a.css", "http://example.com:8080"},
+		{"//fonts.example.com/f.woff2", "fonts.example.com"},
+		{"data:image/png;base64,AAAA", "data:"},
+		{"blob:https://example.com/x", "blob:"},
+		{"mailto:me@example.com", ""},
+		{"  ", ""},
+	} {
+		if got := cspSource(tt.ref); got != tt.want {
+			t.Errorf("cspSource(%q) = %q, want %q", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestPageCSP(t *testing.T) {
+	const style = "body { background: url(https://img.example.com/bg.png) }"
+	const script = "console.log(1)"
+	page := `<!DOCTYPE html><html><head>
+<link rel="stylesheet" href="https://cdn.example.com/a.css">
+<style>` + style + `</style>
+</head><body>
+<p style="color: red" onclick="go()">x</p>
+<img src="/a.png" srcset="https://img.example.com/a-480w.png 480w, /a.png 960w">
+<iframe src="https://video.example.com/embed"></iframe>
+<script src="/app.js"></script>
+<script>` + script + `</script>
+<script type="application/ld+json">{}</script>
+</body></html>`
+
+	for _, tt := range []struct {
+		name string
+		cfg  CSPConfig
+		want string
+	}{
+		{"meta", CSPConfig{Output: "meta"}, "default-src 'self'; " +
+			"script-src 'self' 'unsafe-hashes' " + cspHash("go()") + " " + cspHash(script) + "; " +
+			"style-src 'self' https://cdn.example.com " + cspHash(style) + " 'unsafe-hashes' " + cspHash("color: red") + "; " +
+			"img-src 'self' https://img.example.com; " +
+			"frame-src 'self' https://video.example.com; " +
+			"object-src 'none'; base-uri 'self'; form-action 'self'"},
+		{"headers and sources", CSPConfig{Output: "headers", Sources: map[string][]string{"font-src": {"https://fonts.example.com"}}}, "default-src 'self'; " +
+			"script-src 'self' 'unsafe-hashes' " + cspHash("go()") + " " + cspHash(script) + "; " +
+			"style-src 'self' https://cdn.example.com " + cspHash(style) + " 'unsafe-hashes' " + cspHash("color: red") + "; " +
+			"img-src 'self' https://img.example.com; " +
+			"font-src 'self' https://fonts.example.com; " +
+			"frame-src 'self' https://video.example.com; " +
+			"object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'self'"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pageCSP([]byte(page), tt.cfg).String(); got != tt.want {
+				t.Errorf("policy\n got %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInsertCSPMeta(t *testing.T) {
+	page := []byte(`<!DOCTYPE html><html><head><title>x</title></head><body></body></html>`)
+	got, ok := insertCSPMeta(page, `default-src 'self'; script-src "a"&b`)
+	if !ok {
+		t.Fatal("no <head> found")
+	}
+	want := `<head><meta http-equiv="Content-Security-Policy" content="default-src 'self'; script-src &quot;a&quot;&amp;b"><title>`
+	if !strings.Contains(string(got), want) {
+		t.Errorf("got %s, want it to contain %s", got, want)
+	}
+	if _, ok := insertCSPMeta([]byte(`<p>no head</p>`), "default-src 'self'"); ok {
+		t.Errorf("page without <head> got a policy")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// dataDir holds YAML, JSON and CSV files for pages to use as .Data.
+const dataDir = "data"
+
+// pageTemplateData is what {{ }} expressions in a page can use.
+type pageTemplateData struct {
+	Config Config
+	// Data holds the files in data/, by name without the extension, and
+	// the data: keys from pager.yaml and the page's front matter, which
+	// win over a file of the same name.
+	Data map[string]any
+	// Front holds the front matter of the Markdown files the page
+	// converts; the first file to set a key wins.
+	Front map[string]any
+	Route string
+}
+
+var yamlErrLineRe = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// loadDataDir reads every data file under the site's data directory into
+// nested maps: data/team.yaml is "team" and data/releases/v1.json is
+// "releases" → "v1". A file that doesn't parse fails the build with its
+// file and line.
+func loadDataDir(dir string) (map[string]any, error) {
+	data := make(map[string]any)
+	root := filepath.Join(dir, dataDir)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && p == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			if p != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(p))
+		if ext != ".yaml" && ext != ".yml" && ext != ".json" && ext != ".csv" {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, p)
+		rel = filepath.ToSlash(rel)
+		value, err := readDataFile(p, rel, ext)
+		if err != nil {
+			return err
+		}
+
+		keys := strings.Split(strings.TrimSuffix(strings.TrimPrefix(rel, dataDir+"/"), path.Ext(rel)), "/")
+		m := data
+		for _, k := range keys[:len(keys)-1] {
+			sub, ok := m[k].(map[string]any)
+			if !ok {
+				sub = make(map[string]any)
+				m[k] = sub
+			}
+			m = sub
+		}
+		name := keys[len(keys)-1]
+		if _, ok := m[name]; ok {
+			return fmt.Errorf("%s: another file in %s already defines %q", rel, path.Dir(rel), name)
+		}
+		m[name] = value
+		return nil
+	})
+	return data, err
+}
+
+// readDataFile parses one data file, turning parse errors into errors that
+// start with the file and line.
+func readDataFile(p, rel, ext string) (any, error) {
+	raw, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var value any
+	switch ext {
+	case ".json":
+		if err := json.Unmarshal(raw, &value); err != nil {
+			var syntax *json.SyntaxError
+			if errors.As(err, &syntax) {
+				line := bytes.Count(raw[:syntax.Offset], []byte("\n")) + 1
+				return nil, fmt.Errorf("%s: %s", position{File: rel, Line: line}, syntax)
+			}
+			return nil, fmt.Errorf("%s: %w", rel, err)
+		}
+	case ".csv":
+		// Rows become maps keyed by the header row.
+		records, err := csv.NewReader(bytes.NewReader(raw)).ReadAll()
+		if err != nil {
+			var parse *csv.ParseError
+			if errors.As(err, &parse) {
+				return nil, fmt.Errorf("%s: %v", position{File: rel, Line: parse.Line}, parse.Err)
+			}
+			return nil, fmt.Errorf("%s: %w", rel, err)
+		}
+		rows := []map[string]string{}
+		if len(records) > 0 {
+			for _, record := range records[1:] {
+				row := make(map[string]string, len(records[0]))
+				for i, key := range records[0] {
+					row[key] = record[i]
+				}
+				rows = append(rows, row)
+			}
+		}
+		value = rows
+	default:
+		if err := yaml.Unmarshal(raw, &value); err != nil {
+			if m := yamlErrLineRe.FindStringSubmatch(err.Error()); m != nil {
+				line, _ := strconv.Atoi(m[1])
+				return nil, fmt.Errorf("%s: %s", position{File: rel, Line: line}, m[2])
+			}
+			return nil, fmt.Errorf("%s: %w", rel, err)
+		}
+	}
+	return value, nil
+}
+
+// literalTagRes match the elements whose content is code or TeX, where
+// braces are never template actions: <pre> first, so the <code> inside it
+// is taken as a whole. Self-closing tags have no content to match.
+var literalTagRes = []*regexp.Regexp{
+	regexp.MustCompile(`(?is)(<pre(?:\s(?:[^>]*[^/>])?)?>)(.*?)(</pre\s*>)`),
+	regexp.MustCompile(`(?is)(<code(?:\s(?:[^>]*[^/>])?)?>)(.*?)(</code\s*>)`),
+	regexp.MustCompile(`(?is)(<math-tex(?:\s(?:[^>]*[^/>])?)?>)(.*?)(</math-tex\s*>)`),
+	regexp.MustCompile(`(?is)(<syntax(?:\s(?:[^>]*[^/>])?)?>)(.*?)(</syntax\s*>)`),
+}
+
+// protectLiterals swaps the content of every <pre>, <code>, <math-tex> and
+// <syntax> holding "{{" for a placeholder, keeping its line breaks so
+// template errors still point at the right line. restore puts it back.
+func protectLiterals(content string) (protected string, restore func(string) string) {
+	var placeholders, literals []string
+	for _, re := range literalTagRes {
+		content = re.ReplaceAllStringFunc(content, func(match string) string {
+			m := re.FindStringSubmatch(match)
+			if !strings.Contains(m[2], "{{") {
+				return match
+			}
+			placeholder := fmt.Sprintf("\uE000%d\uE000", len(placeholders)) + strings.Repeat("\n", strings.Count(m[2], "\n"))
+			placeholders = append(placeholders, placeholder)
+			literals = append(literals, m[2])
+			return m[1] + placeholder + m[3]
+		})
+	}
+	return content, func(s string) string {
+		// A literal can hold placeholders made before it, so the last
+		// ones are restored first.
+		for i := len(placeholders) - 1; i >= 0; i-- {
+			s = strings.ReplaceAll(s, placeholders[i], literals[i])
+		}
+		return s
+	}
+}
+
+// executePageTemplate runs a page's annotated content as an html/template.
+// Content without any {{ }} actions is returned as it is, and so is the
+// content of code blocks and math, where braces are common. Errors start
+// with the page's file and line; lineOffset is the number of lines of
+// front matter before content.
+func executePageTemplate(content, src string, lineOffset int, data pageTemplateData) (string, error) {
+	if !strings.Contains(content, "{{") {
+		return content, nil
+	}
+	protected, restore := protectLiterals(content)
+	if !strings.Contains(protected, "{{") {
+		return content, nil
+	}
+	tmpl, err := template.New(src).Parse(protected)
+	if err == nil {
+		var buf bytes.Buffer
+		if err = tmpl.Execute(&buf, data); err == nil {
+			return restore(buf.String()), nil
+		}
+	}
+	// Columns are skipped, since annotating the content shifts them.
+	pos, msg := templateError(err, src, lineOffset)
+	pos.Col = 0
+	return "", fmt.Errorf("%s: %s", pos, msg)
+}
+
+// pageData merges a page's data: keys over the site's data files.
+func pageData(files, keys map[string]any) map[string]any {
+	data := maps.Clone(files)
+	if data == nil {
+		data = make(map[string]any)
+	}
+	maps.Copy(data, keys)
+	return data
+}
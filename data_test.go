@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProtectLiterals(t *testing.T) {
+	for _, tt := range []struct {
+		name, in string
+		hidden   []string // literal text the template must not see
+	}{
+		{"pre", "<p>{{ .Route }}</p><pre>{{ x }}</pre>", []string{"{{ x }}"}},
+		{"code with attributes", `<code class="go">{{ y }}</code>`, []string{"{{ y }}"}},
+		{"code inside pre", "<pre><code>a {{ b }}\nc</code></pre>", []string{"{{ b }}"}},
+		{"math and syntax", "<math-tex>\\frac{{a}}{b}</math-tex><syntax lang=\"go\">{{ c }}</syntax>", []string{"{{a}}", "{{ c }}"}},
+		{"no braces", "<pre>plain</pre>", nil},
+		{"self-closing", "<code/>{{ .Route }}<code>}}</code>", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			protected, restore := protectLiterals(tt.in)
+			for _, h := range tt.hidden {
+				if strings.Contains(protected, h) {
+					t.Errorf("protected %q still holds %q", protected, h)
+				}
+			}
+			if tt.hidden == nil && protected != tt.in {
+				t.Errorf("protected %q, want it unchanged", protected)
+			}
+			if strings.Count(protected, "\n") != strings.Count(tt.in, "\n") {
+				t.Errorf("protected %q changed the line count of %q", protected, tt.in)
+			}
+			if got := restore(protected); got != tt.in {
+				t.Errorf("restored %q, want %q", got, tt.in)
+			}
+		})
+	}
+}
+
+func TestExecutePageTemplate(t *testing.T) {
+	data := pageTemplateData{Route: "/blog/", Data: map[string]any{"name": "Ada"}}
+	for _, tt := range []struct {
+		in, want, err string
+	}{
+		{"<p>{{ .Data.name }} at {{ .Route }}</p>", "<p>Ada at /blog/</p>", ""},
+		{"<pre>{{ .Data.name }}</pre>{{ .Route }}", "<pre>{{ .Data.name }}</pre>/blog/", ""},
+		{"<p>no actions</p>", "<p>no actions</p>", ""},
+		{"<p>\n{{ .Route</p>", "", "pager.html:4: "},
+	} {
+		got, err := executePageTemplate(tt.in, "pager.html", 2, data)
+		switch {
+		case tt.err != "":
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("executePageTemplate(%q) error = %v, want one starting %q", tt.in, err, tt.err)
+			}
+		case err != nil:
+			t.Errorf("executePageTemplate(%q): %v", tt.in, err)
+		case got != tt.want:
+			t.Errorf("executePageTemplate(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
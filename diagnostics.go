@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"golang.org/x/net/html"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	severityInfo    = "info" // logged and listed, but never fails anything
+	severityWarning = "warning"
+	severityError   = "error"
+)
+
+// rules lists every diagnostic the build can report, with its default severity.
+var rules = map[string]string{
+	"meta-missing":      severityWarning, // title, description, domain, favicon or card not set
+	"meta-length":       severityWarning, // title or description too long for search results
+	"file-missing":      severityError,   // a referenced local file does not exist
+	"attr-empty":        severityWarning, // src, poster or href set to ""
+	"img-alt":           severityWarning, // <img> without alt text
+	"link-text":         severityWarning, // link with no text and no aria-label
+	"link-url":          severityError,   // absolute link that does not parse
+	"link-localhost":    severityWarning, // link to localhost
+	"link-anchor":       severityError,   // #fragment with no matching id
+	"link-file":         severityError,   // local link to a missing file or page
+	"css-glob":          severityWarning, // css: glob that is invalid or matches nothing
+	"css-read":          severityWarning, // css: file that could not be read
+	"css-bundle":        severityWarning, // css: files that esbuild could not bundle
+	"purge-css":         severityWarning, // purge_css that can't be applied, or a bad purge_safelist pattern
+	"purge-css-saved":   severityInfo,    // how much purge_css removed from a page's stylesheets
+	"js-glob":           severityWarning, // js: glob that is invalid or matches nothing
+	"js-build":          severityError,   // js: entry that esbuild could not bundle
+	"js-warning":        severityWarning, // esbuild warning while bundling a js: entry
+	"theme-unknown":     severityWarning, // unknown chroma theme
+	"tailwind":          severityWarning, // Tailwind CLI missing or failing
+	"convert":           severityWarning, // <convert> that could not be expanded
+	"include":           severityWarning, // <include> missing a parameter its partial uses
+	"include-cycle":     severityError,   // <include> that ends up including itself
+	"component":         severityError,   // components/x-*.html template that fails to parse or run
+	"component-unknown": severityError,   // x-* element with no template in components/
+	"component-attr":    severityError,   // x-* element missing an attribute its component requires
+	"component-cycle":   severityError,   // component that ends up using itself
+	"template-content":  severityWarning, // custom template: that never outputs .Content
+	"syntax":            severityWarning, // <syntax> that could not be highlighted
+	"math":              severityWarning, // <math-tex> or $...$ using TeX the math renderer doesn't support
+	"markdown-output":   severityWarning, // index.md could not be generated
+	"lint-config":       severityWarning, // lint: entry with an unknown rule or level
+	"link-broken":       severityError,   // external URL answered with a 4xx or 5xx status
+	"link-unreachable":  severityWarning, // external URL could not be fetched at all
+	"link-redirect":     severityWarning, // external URL redirects elsewhere
+	"image-resize":      severityWarning, // responsive image variants could not be generated
+	"image-placeholder": severityWarning, // image placeholder could not be computed
+	"asset-hash":        severityWarning, // hash_assets set without a separate out: directory
+	"sri":               severityWarning, // remote css: or js: file that could not be downloaded to hash
+	"sri-changed":       severityWarning, // remote css: or js: file changed since its hash was pinned
+	"csp":               severityWarning, // csp: that can't be applied as configured
+	"cache":             severityWarning, // .pager-cache file that could not be read or written
+}
+
+// position is a location in a source file. Line and column are 1-based and
+// zero when unknown.
+type position struct {
+	File string `json:"file,omitempty"`
+	Line int    `json:"line,omitempty"`
+	Col  int    `json:"column,omitempty"`
+}
+
+func (p position) String() string {
+	switch {
+	case p.File == "":
+		return ""
+	case p.Line == 0:
+		return p.File
+	case p.Col == 0:
+		return fmt.Sprintf("%s:%d", p.File, p.Line)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+type diagnostic struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	position
+}
+
+// diagnosticLog collects everything a build reports. Unless quiet, each
+// diagnostic is also logged as it arrives, so the dev server shows them live.
+type diagnosticLog struct {
+	mu    sync.Mutex
+	items []diagnostic
+	quiet bool
+}
+
+// diagnostics reports into a shared log, applying the lint levels configured
+// for the site or page being checked.
+type diagnostics struct {
+	*diagnosticLog
+	levels map[string]string
+}
+
+func newDiagnostics(quiet bool) *diagnostics {
+	return &diagnostics{diagnosticLog: &diagnosticLog{quiet: quiet}}
+}
+
+// withLint returns a view of d that applies the given lint levels.
+func (d *diagnostics) withLint(levels map[string]string) *diagnostics {
+	return &diagnostics{diagnosticLog: d.diagnosticLog, levels: levels}
+}
+
+// severity returns the severity rule fires at, or "" when it is turned off.
+func (d *diagnostics) severity(rule string) string {
+	switch d.levels[rule] {
+	case "off":
+		return ""
+	case "warn", "warning":
+		return severityWarning
+	case "error":
+		return severityError
+	}
+	if sev, ok := rules[rule]; ok {
+		return sev
+	}
+	return severityWarning
+}
+
+func (d *diagnostics) report(rule string, pos position, format string, args ...any) {
+	diag := diagnostic{
+		Rule:     rule,
+		Severity: d.severity(rule),
+		Message:  fmt.Sprintf(format, args...),
+		position: pos,
+	}
+	if diag.Severity == "" {
+		return
+	}
+
+	d.mu.Lock()
+	d.items = append(d.items, diag)
+	d.mu.Unlock()
+
+	if !d.quiet {
+		logDiagnostic(diag)
+	}
+}
+
+// checkLint reports lint: entries that name an unknown rule or level.
+func (d *diagnostics) checkLint(levels map[string]string, pos position) {
+	for rule, level := range levels {
+		if _, ok := rules[rule]; !ok {
+			d.report("lint-config", pos, "lint: unknown rule %q", rule)
+		}
+		switch level {
+		case "off", "warn", "warning", "error":
+		default:
+			d.report("lint-config", pos, "lint: %s has unknown level %q (use off, warn or error)", rule, level)
+		}
+	}
+}
+
+// ignoredRules parses a <!-- pager-ignore rule-id ... --> comment. An empty
+// list of rules ignores every rule.
+func ignoredRules(comment string) (map[string]bool, bool) {
+	fields := strings.Fields(comment)
+	if len(fields) == 0 || fields[0] != "pager-ignore" {
+		return nil, false
+	}
+	ignored := make(map[string]bool)
+	if len(fields) == 1 {
+		ignored["*"] = true
+	}
+	for _, rule := range fields[1:] {
+		ignored[strings.TrimSuffix(rule, ",")] = true
+	}
+	return ignored, true
+}
+
+// voidElements never have content or an end tag.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true,
+}
+
+// ignoredByTag maps the position of each start tag in content, as
+// annotatePositions recorded it, to the pager-ignore comments in effect
+// there: the one right before it and those before the elements around it.
+// Tags that are expanded before the page is parsed use it to honor the
+// same comments processSiblings does.
+func ignoredByTag(content string) map[string][]map[string]bool {
+	if !strings.Contains(content, "pager-ignore") {
+		return nil
+	}
+	type openElement struct {
+		name    string
+		ignored map[string]bool
+	}
+	var open []openElement
+	var pending map[string]bool
+	byTag := make(map[string][]map[string]bool)
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return byTag
+		case html.CommentToken:
+			if ignored, ok := ignoredRules(string(z.Text())); ok {
+				pending = ignored
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			var active []map[string]bool
+			for _, e := range open {
+				if e.ignored != nil {
+					active = append(active, e.ignored)
+				}
+			}
+			if pending != nil {
+				active = append(active, pending)
+			}
+			for _, a := range tok.Attr {
+				if a.Key == posAttr && len(active) > 0 {
+					byTag[a.Val] = active
+				}
+			}
+			if tok.Type == html.StartTagToken && !voidElements[tok.Data] {
+				open = append(open, openElement{tok.Data, pending})
+			}
+			pending = nil
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i].name == string(name) {
+					open = open[:i]
+					break
+				}
+			}
+			pending = nil
+		}
+	}
+}
+
+func logDiagnostic(diag diagnostic) {
+	label := "\033[33mWARNING\033[0m"
+	switch diag.Severity {
+	case severityError:
+		label = "\033[31mERROR\033[0m"
+	case severityInfo:
+		label = "\033[36mINFO\033[0m"
+	}
+	if where := diag.position.String(); where != "" {
+		log.Printf("%s %s: %s (%s)", label, where, diag.Message, diag.Rule)
+	} else {
+		log.Printf("%s %s (%s)", label, diag.Message, diag.Rule)
+	}
+}
+
+// counts returns the number of error- and warning-level diagnostics.
+func (d *diagnosticLog) counts() (errs, warnings int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, diag := range d.items {
+		switch diag.Severity {
+		case severityError:
+			errs++
+		case severityWarning:
+			warnings++
+		}
+	}
+	return errs, warnings
+}
+
+// summary describes the counts in words, such as "2 errors, 1 warning".
+func (d *diagnosticLog) summary() string {
+	errs, warnings := d.counts()
+	return fmt.Sprintf("%s, %s", plural(errs, "error"), plural(warnings, "warning"))
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// writeJSON writes every collected diagnostic as a JSON array.
+func (d *diagnosticLog) writeJSON(w io.Writer) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	items := d.items
+	if items == nil {
+		items = []diagnostic{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(items)
+}
+
+// reporter records diagnostics at a fixed position.
+type reporter func(rule, format string, args ...any)
+
+func (d *diagnostics) at(pos position) reporter {
+	return func(rule, format string, args ...any) {
+		d.report(rule, pos, format, args...)
+	}
+}
+
+// posAttr carries an element's source position through <convert> and
+// <syntax> expansion and HTML parsing. processNode strips it again.
+const posAttr = "data-pager-pos"
+
+func formatPos(pos position) string {
+	return fmt.Sprintf("%d:%d:%s", pos.Line, pos.Col, pos.File)
+}
+
+func parsePos(v string) (position, bool) {
+	parts := strings.SplitN(v, ":", 3)
+	if len(parts) != 3 {
+		return position{}, false
+	}
+	line, err1 := strconv.Atoi(parts[0])
+	col, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return position{}, false
+	}
+	return position{File: parts[2], Line: line, Col: col}, true
+}
+
+// annotatePositions tags every start tag in src with its line and column in
+// file. lineOffset is added to every line, for content that followed
+// stripped front matter. Template actions are left alone, so a "<" or a
+// quote inside {{ }} is never mistaken for markup.
+func annotatePositions(src, file string, lineOffset int) string {
+	var sb strings.Builder
+	sb.Grow(len(src) + len(src)/4)
+	z := html.NewTokenizer(strings.NewReader(maskTemplateActions(src)))
+	line, col := 1+lineOffset, 1
+	offset := 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		// The masked source has the same length as src, so the token's
+		// bytes can be taken from src itself.
+		raw := []byte(src[offset : offset+len(z.Raw())])
+		offset += len(raw)
+		if tt == html.StartTagToken || tt == html.SelfClosingTagToken {
+			nameEnd := 1
+			for nameEnd < len(raw) && !strings.ContainsRune(" \t\r\n\f/>", rune(raw[nameEnd])) {
+				nameEnd++
+			}
+			pos := position{File: file, Line: line, Col: col}
+			sb.Write(raw[:nameEnd])
+			fmt.Fprintf(&sb, " %s=\"%s\"", posAttr, html.EscapeString(formatPos(pos)))
+			sb.Write(raw[nameEnd:])
+		} else {
+			sb.Write(raw)
+		}
+		for _, c := range raw {
+			if c == '\n' {
+				line++
+				col = 1
+			} else if c&0xC0 != 0x80 {
+				col++
+			}
+		}
+	}
+	return sb.String()
+}
+
+// maskTemplateActions returns src with the inside of every {{ }} action
+// blanked out, keeping its length and line breaks.
+func maskTemplateActions(src string) string {
+	if !strings.Contains(src, "{{") {
+		return src
+	}
+	masked := []byte(src)
+	for i := 0; ; {
+		start := strings.Index(src[i:], "{{")
+		if start < 0 {
+			break
+		}
+		start += i
+		end := strings.Index(src[start+2:], "}}")
+		if end < 0 {
+			end = len(src)
+		} else {
+			end += start + 4
+		}
+		for j := start; j < end; j++ {
+			if masked[j] != '\n' {
+				masked[j] = '_'
+			}
+		}
+		i = end
+	}
+	return string(masked)
+}
+
+// takePos removes posAttr from n and returns the position it held.
+func takePos(n *html.Node) (position, bool) {
+	for i, a := range n.Attr {
+		if a.Key == posAttr {
+			n.Attr = append(n.Attr[:i], n.Attr[i+1:]...)
+			return parsePos(a.Val)
+		}
+	}
+	return position{}, false
+}
+
+// lineCol converts a byte offset in src to a 1-based line and column.
+func lineCol(src []byte, offset int) (int, int) {
+	if offset > len(src) {
+		offset = len(src)
+	}
+	before := src[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	lineStart := bytes.LastIndexByte(before, '\n') + 1
+	return line, len([]rune(string(before[lineStart:]))) + 1
+}
+
+// yamlKeyPositions maps each top-level key in a YAML document to the
+// position of that key, so config diagnostics can point at the right line.
+func yamlKeyPositions(raw []byte, file string, lineOffset int) map[string]position {
+	positions := make(map[string]position)
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil || len(doc.Content) == 0 {
+		return positions
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return positions
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key := root.Content[i]
+		positions[key.Value] = position{File: file, Line: key.Line + lineOffset, Col: key.Column}
+	}
+	return positions
+}
+
+// mdFileKey holds the path of the Markdown file being converted, for
+// markdownPositions.
+var mdFileKey = parser.NewContextKey()
+
+// mdLineOffsetKey holds the number of front matter lines stripped from the
+// top of the Markdown file, for markdownPositions.
+var mdLineOffsetKey = parser.NewContextKey()
+
+// markdownPositions tags rendered Markdown elements with their position in
+// the source .md file, the same way annotatePositions does for HTML.
+type markdownPositions struct{}
+
+func (markdownPositions) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	file, _ := pc.Get(mdFileKey).(string)
+	if file == "" {
+		return
+	}
+	lineOffset, _ := pc.Get(mdLineOffsetKey).(int)
+	source := reader.Source()
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering || n.Kind() == ast.KindDocument || n.Kind() == ast.KindText {
+			return ast.WalkContinue, nil
+		}
+		offset, ok := markdownOffset(n)
+		if !ok {
+			return ast.WalkContinue, nil
+		}
+		line, col := lineCol(source, offset)
+		n.SetAttributeString(posAttr, []byte(formatPos(position{File: file, Line: line + lineOffset, Col: col})))
+		return ast.WalkContinue, nil
+	})
+}
+
+// markdownOffset finds the first source byte belonging to n.
+func markdownOffset(n ast.Node) (int, bool) {
+	if n.Type() == ast.TypeBlock && n.Lines().Len() > 0 {
+		return n.Lines().At(0).Start, true
+	}
+	if t, ok := n.(*ast.Text); ok {
+		return t.Segment.Start, true
+	}
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		if offset, ok := markdownOffset(c); ok {
+			return offset, true
+		}
+	}
+	return 0, false
+}
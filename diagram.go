@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+// Each character of a diagram takes a cell this many pixels wide and high.
+const (
+	diagramCellW = 8
+	diagramCellH = 16
+)
+
+// diagramSVG draws ASCII art as an inline SVG: lines, corners, arrows and
+// dots become strokes, and everything else stays as text. It draws in
+// currentColor, so it follows the text color of the page. The source is
+// kept in the SVG's <metadata> for index.md. alt, if set, labels the
+// diagram for screen readers.
+func diagramSVG(source, alt string) string {
+	g := newDiagramGrid(source)
+	if len(g.cells) == 0 {
+		return ""
+	}
+	width, height := g.width*diagramCellW, len(g.cells)*diagramCellH
+
+	var lines, fills, texts strings.Builder
+	for r, row := range g.cells {
+		for c, ch := range row {
+			if ch == ' ' {
+				continue
+			}
+			if g.drawn[r][c] {
+				g.draw(&lines, &fills, r, c)
+				continue
+			}
+			fmt.Fprintf(&texts, `<text x="%d" y="%d">%s</text>`, c*diagramCellW+diagramCellW/2, r*diagramCellH+12, html.EscapeString(string(ch)))
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg class="diagram" xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d"`, width, height, width, height)
+	if alt != "" {
+		fmt.Fprintf(&b, ` role="img" aria-label="%s"`, html.EscapeString(alt))
+	}
+	b.WriteString("><metadata>" + html.EscapeString(g.source) + "</metadata>")
+	if lines.Len() > 0 {
+		b.WriteString(`<path d="` + strings.TrimSpace(lines.String()) + `" fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round"/>`)
+	}
+	if fills.Len() > 0 {
+		b.WriteString(`<path d="` + strings.TrimSpace(fills.String()) + `" fill="currentColor"/>`)
+	}
+	if texts.Len() > 0 {
+		b.WriteString(`<g fill="currentColor" font-family="monospace" font-size="13" text-anchor="middle">` + texts.String() + "</g>")
+	}
+	b.WriteString("</svg>")
+	return b.String()
+}
+
+// diagramGrid is a diagram's characters, one rune per cell, with the
+// cells that are part of the drawing rather than text marked.
+type diagramGrid struct {
+	source string // the diagram without surrounding blank lines
+	cells  [][]rune
+	drawn  [][]bool
+	width  int
+}
+
+func newDiagramGrid(source string) *diagramGrid {
+	var rows []string
+	for _, line := range strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n") {
+		rows = append(rows, strings.TrimRightFunc(expandTabs(line), unicode.IsSpace))
+	}
+	for len(rows) > 0 && rows[0] == "" {
+		rows = rows[1:]
+	}
+	for len(rows) > 0 && rows[len(rows)-1] == "" {
+		rows = rows[:len(rows)-1]
+	}
+
+	g := &diagramGrid{source: strings.Join(rows, "\n")}
+	for _, row := range rows {
+		cells := []rune(row)
+		g.cells = append(g.cells, cells)
+		g.width = max(g.width, len(cells))
+	}
+	g.drawn = make([][]bool, len(g.cells))
+	for r, row := range g.cells {
+		g.drawn[r] = make([]bool, len(row))
+		for c := range row {
+			g.drawn[r][c] = g.isDrawing(r, c)
+		}
+	}
+	return g
+}
+
+// expandTabs replaces tabs with spaces up to the next multiple of 8
+// columns.
+func expandTabs(line string) string {
+	if !strings.Contains(line, "\t") {
+		return line
+	}
+	var b strings.Builder
+	col := 0
+	for _, ch := range line {
+		if ch == '\t' {
+			b.WriteByte(' ')
+			for col++; col%8 != 0; col++ {
+				b.WriteByte(' ')
+			}
+			continue
+		}
+		b.WriteRune(ch)
+		col++
+	}
+	return b.String()
+}
+
+func (g *diagramGrid) at(r, c int) rune {
+	if r < 0 || r >= len(g.cells) || c < 0 || c >= len(g.cells[r]) {
+		return ' '
+	}
+	return g.cells[r][c]
+}
+
+func (g *diagramGrid) isDrawn(r, c int) bool {
+	return r >= 0 && r < len(g.drawn) && c >= 0 && c < len(g.drawn[r]) && g.drawn[r][c]
+}
+
+// isDrawing reports whether the character at r, c is part of the drawing,
+// going by its neighbours: a - between letters is a hyphen, and a + with
+// no lines around it is a plus sign.
+func (g *diagramGrid) isDrawing(r, c int) bool {
+	left, right, up, down := g.at(r, c-1), g.at(r, c+1), g.at(r-1, c), g.at(r+1, c)
+	in := func(ch rune, set string) bool { return strings.ContainsRune(set, ch) }
+	switch g.at(r, c) {
+	case '|':
+		return true
+	case '-':
+		return in(left, "-+.'<*|") || in(right, "-+.'>*|")
+	case '_':
+		return in(left, "_|") || in(right, "_|")
+	case '+':
+		return in(left, "-+.'<*_") || in(right, "-+.'>*_") || in(up, "|+.^*") || in(down, "|+'v*")
+	case '.':
+		return (in(left, "-+_") || in(right, "-+_")) && in(down, "|+'")
+	case '\'':
+		return (in(left, "-+_") || in(right, "-+_")) && in(up, "|+.")
+	case '>':
+		return in(left, "-+")
+	case '<':
+		return in(right, "-+")
+	case '^':
+		return in(down, "|+")
+	case 'v', 'V':
+		return in(up, "|+") && !unicode.IsLetter(left) && !unicode.IsLetter(right)
+	case '/':
+		return in(g.at(r-1, c+1), "/+.'|_") || in(g.at(r+1, c-1), "/+.'|_")
+	case '\\':
+		return in(g.at(r-1, c-1), "\\+.'|_") || in(g.at(r+1, c+1), "\\+.'|_")
+	case '*':
+		return in(left, "-+") || in(right, "-+") || in(up, "|+") || in(down, "|+")
+	}
+	return false
+}
+
+// joins reports whether the drawn cell at r, c has a line coming in from
+// the neighbour at r+dr, c+dc.
+func (g *diagramGrid) joins(r, c, dr, dc int) bool {
+	if !g.isDrawn(r+dr, c+dc) {
+		return false
+	}
+	ch := g.at(r+dr, c+dc)
+	switch {
+	case dc < 0:
+		return strings.ContainsRune("-+.'*<", ch)
+	case dc > 0:
+		return strings.ContainsRune("-+.'*>", ch)
+	case dr < 0:
+		return strings.ContainsRune("|+.*^", ch)
+	default:
+		return strings.ContainsRune("|+'*vV", ch)
+	}
+}
+
+// draw adds the strokes and filled shapes for the drawn cell at r, c.
+func (g *diagramGrid) draw(lines, fills *strings.Builder, r, c int) {
+	x0, y0 := c*diagramCellW, r*diagramCellH
+	x1, y1 := x0+diagramCellW, y0+diagramCellH
+	cx, cy := x0+diagramCellW/2, y0+diagramCellH/2
+	line := func(ax, ay, bx, by int) { fmt.Fprintf(lines, "M%d %dL%d %d ", ax, ay, bx, by) }
+	// spokes draws from the center to each side a line comes in from.
+	spokes := func() {
+		if g.joins(r, c, 0, -1) {
+			line(cx, cy, x0, cy)
+		}
+		if g.joins(r, c, 0, 1) {
+			line(cx, cy, x1, cy)
+		}
+		if g.joins(r, c, -1, 0) {
+			line(cx, cy, cx, y0)
+		}
+		if g.joins(r, c, 1, 0) {
+			line(cx, cy, cx, y1)
+		}
+	}
+
+	switch g.at(r, c) {
+	case '-':
+		line(x0, cy, x1, cy)
+	case '_':
+		line(x0, y1, x1, y1)
+	case '|':
+		line(cx, y0, cx, y1)
+	case '/':
+		line(x0, y1, x1, y0)
+	case '\\':
+		line(x0, y0, x1, y1)
+	case '+':
+		spokes()
+	case '*':
+		spokes()
+		fmt.Fprintf(fills, "M%d %da3 3 0 1 0 6 0a3 3 0 1 0-6 0Z ", cx-3, cy)
+	case '.', '\'':
+		// Rounded corners, curving from the side lines into the vertical.
+		ey := y1
+		if g.at(r, c) == '\'' {
+			ey = y0
+		}
+		my := cy + (ey-cy)/2
+		for _, side := range []struct{ dc, x int }{{-1, x0}, {1, x1}} {
+			if g.joins(r, c, 0, side.dc) || g.at(r, c+side.dc) == '_' {
+				fmt.Fprintf(lines, "M%d %dQ%d %d %d %dL%d %d ", side.x, cy, cx, cy, cx, my, cx, ey)
+			}
+		}
+	case '>':
+		fmt.Fprintf(fills, "M%d %dL%d %dL%d %dZ ", x0, cy-4, x1, cy, x0, cy+4)
+	case '<':
+		fmt.Fprintf(fills, "M%d %dL%d %dL%d %dZ ", x1, cy-4, x0, cy, x1, cy+4)
+	case '^':
+		line(cx, y0+10, cx, y1)
+		fmt.Fprintf(fills, "M%d %dL%d %dL%d %dZ ", cx-4, y0+10, cx, y0+2, cx+4, y0+10)
+	case 'v', 'V':
+		line(cx, y0, cx, y1-10)
+		fmt.Fprintf(fills, "M%d %dL%d %dL%d %dZ ", cx-4, y1-10, cx, y1-2, cx+4, y1-10)
+	}
+}
+
+// diagramSource returns the ASCII art kept in a diagram drawn by
+// diagramSVG.
+func diagramSource(n *html.Node) (string, bool) {
+	if !strings.Contains(" "+getAttr(n, "class")+" ", " diagram ") {
+		return "", false
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.Data == "metadata" {
+			return textContent(c), true
+		}
+	}
+	return "", false
+}
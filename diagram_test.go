@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// drawnMask shows which cells of g are drawn (#) and which are text (.).
+func drawnMask(g *diagramGrid) string {
+	var rows []string
+	for r, row := range g.cells {
+		var b strings.Builder
+		for c, ch := range row {
+			switch {
+			case ch == ' ':
+				b.WriteByte(' ')
+			case g.drawn[r][c]:
+				b.WriteByte('#')
+			default:
+				b.WriteByte('.')
+			}
+		}
+		rows = append(rows, b.String())
+	}
+	return strings.Join(rows, "\n")
+}
+
+func TestDiagramGrid(t *testing.T) {
+	for _, tt := range []struct {
+		name, source, want string
+	}{
+		{"box", "\n\n+---+\n| A |\n+---+\n\n", "#####\n# . #\n#####"},
+		{"arrows", "A <--> B\n--> C", ". #### .\n### ."},
+		{"vertical arrow", "|\nv", "#\n#"},
+		{"hyphens", "a-b well-known", "... .........."},
+		{"arithmetic", "x = y - 1 + 2", ". . . . . . ."},
+		{"tabs", "\t|", "        #"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := drawnMask(newDiagramGrid(tt.source)); got != tt.want {
+				t.Errorf("drawn cells of %q:\n%s\nwant:\n%s", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiagramSVG(t *testing.T) {
+	if got := diagramSVG("\n  \n", ""); got != "" {
+		t.Errorf("blank diagram drew %s", got)
+	}
+
+	got := diagramSVG("--> A&B", "flow")
+	for _, want := range []string{
+		`<svg class="diagram" xmlns="http://www.w3.org/2000/svg" width="56" height="16" viewBox="0 0 56 16" role="img" aria-label="flow">`,
+		`<metadata>--&gt; A&amp;B</metadata>`,
+		`<path d="M0 8L8 8 M8 8L16 8" fill="none" stroke="currentColor"`,
+		`<path d="M16 4L24 8L16 12Z" fill="currentColor"/>`,
+		`<text x="36" y="12">A</text><text x="44" y="12">&amp;</text>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %s, want it to contain %s", got, want)
+		}
+	}
+
+	// The source comes back out of the SVG for index.md.
+	nodes, err := html.ParseFragment(strings.NewReader(got), &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div})
+	if err != nil || len(nodes) != 1 {
+		t.Fatalf("parsing %s: %d nodes, %v", got, len(nodes), err)
+	}
+	if source, ok := diagramSource(nodes[0]); !ok || source != "--> A&B" {
+		t.Errorf("diagramSource = %q, %v, want the ASCII art back", source, ok)
+	}
+}
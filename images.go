@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/net/html"
+)
+
+// ImagesConfig enables the responsive image pipeline and placeholders. With
+// no widths set, images are not resized.
+type ImagesConfig struct {
+	Widths  []int  `yaml:"widths"`
+	Sizes   string `yaml:"sizes"`
+	Quality int    `yaml:"quality"`
+	// Placeholder is "color" or "blur"; empty leaves images without one.
+	Placeholder string `yaml:"placeholder"`
+}
+
+// imagePipeline plans resized variants of local images in the output
+// directory. Nothing is written until the build has passed its checks;
+// see resizeImages.
+type imagePipeline struct {
+	cfg      ImagesConfig
+	dir      string
+	outDir   string
+	hashed   bool                     // name variants after the original's content hash
+	variants map[string]*imageVariant // by destination, shared by every page
+}
+
+// imageVariant is one resized copy of a local image.
+type imageVariant struct {
+	src     string // the original
+	ref     string // how the page refers to the original
+	dest    string
+	width   int
+	quality int
+	report  reporter // where the image is first used
+}
+
+// variantPath inserts the width before the extension: photo.jpg becomes
+// photo-480w.jpg.
+func variantPath(p string, width int) string {
+	ext := path.Ext(p)
+	return fmt.Sprintf("%s-%dw%s", strings.TrimSuffix(p, ext), width, ext)
+}
+
+// responsive plans the variants of the image at rel (relative to the site
+// dir) and returns the srcset candidates for src, the reference used in the
+// page. Widths at or above the original's are skipped.
+func (ip *imagePipeline) responsive(src, rel string, width int, report reporter) (string, error) {
+	ext := strings.ToLower(path.Ext(rel))
+	if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+		return "", nil
+	}
+
+	srcPath := filepath.Join(ip.dir, filepath.FromSlash(rel))
+	if _, err := os.Stat(srcPath); err != nil {
+		return "", err
+	}
+
+	if i := strings.IndexAny(src, "?#"); i >= 0 {
+		src = src[:i]
+	}
+	variant := variantPath
+	if ip.hashed {
+		hash, err := hashFile(srcPath)
+		if err != nil {
+			return "", err
+		}
+		variant = func(p string, width int) string {
+			return hashedName(variantPath(p, width), hash)
+		}
+	}
+	var candidates []string
+	for _, w := range ip.cfg.Widths {
+		if w <= 0 || w >= width {
+			continue
+		}
+		dest := filepath.Join(ip.outDir, filepath.FromSlash(variant(rel, w)))
+		candidates = append(candidates, fmt.Sprintf("%s %dw", variant(src, w), w))
+		if _, ok := ip.variants[dest]; !ok {
+			ip.variants[dest] = &imageVariant{src: srcPath, ref: src, dest: dest, width: w, quality: ip.cfg.Quality, report: report}
+		}
+	}
+	if len(candidates) == 0 {
+		return "", nil
+	}
+	candidates = append(candidates, fmt.Sprintf("%s %dw", src, width))
+	return strings.Join(candidates, ", "), nil
+}
+
+// resizes reports whether the pipeline plans variants. They are never
+// written into the source directory, where they would pile up next to the
+// originals.
+func (ip *imagePipeline) resizes() bool {
+	return len(ip.cfg.Widths) > 0 && ip.outDir != filepath.Clean(ip.dir)
+}
+
+func decodeImage(p string) (image.Image, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// resizeImages encodes the image variants the pages use, skipping ones
+// newer than their original, and returns them by destination. Images that
+// can't be resized are reported where they are used. Nothing is written, so
+// that --strict can still stop the build.
+func (site *siteBuild) resizeImages() map[string][]byte {
+	bySrc := make(map[string][]string)
+	for dest, v := range site.images {
+		srcInfo, err := os.Stat(v.src)
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(dest); err == nil && !info.ModTime().Before(srcInfo.ModTime()) {
+			continue
+		}
+		bySrc[v.src] = append(bySrc[v.src], dest)
+	}
+	srcs := make([]string, 0, len(bySrc))
+	for src := range bySrc {
+		srcs = append(srcs, src)
+	}
+	sort.Strings(srcs)
+
+	encoded := make(map[string][]byte)
+	for _, src := range srcs {
+		dests := bySrc[src]
+		sort.Strings(dests)
+		img, err := decodeImage(src)
+		if err != nil {
+			v := site.images[dests[0]]
+			v.report("image-resize", "<img src=%q> could not be resized: %v", v.ref, err)
+			continue
+		}
+		for _, dest := range dests {
+			v := site.images[dest]
+			data, err := encodeVariant(img, dest, v.width, v.quality)
+			if err != nil {
+				v.report("image-resize", "<img src=%q> could not be resized: %v", v.ref, err)
+				continue
+			}
+			encoded[dest] = data
+		}
+	}
+	return encoded
+}
+
+// encodeVariant scales src to width and encodes it in the format dest's
+// extension names.
+func encodeVariant(src image.Image, dest string, width, quality int) ([]byte, error) {
+	bounds := src.Bounds()
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+	var buf bytes.Buffer
+	var err error
+	if strings.ToLower(filepath.Ext(dest)) == ".png" {
+		err = png.Encode(&buf, dst)
+	} else {
+		if quality <= 0 {
+			quality = 80
+		}
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality})
+	}
+	return buf.Bytes(), err
+}
+
+// sizeImage adds srcset, sizes, width and height to a local <img> whose
+// dimensions are known.
+func (s *processState) sizeImage(n *html.Node, src string, width, height int) {
+	if s.images == nil || len(s.images.cfg.Widths) == 0 {
+		return
+	}
+	if !hasAttr(n, "srcset") && s.images.resizes() {
+		if p, _, ok := resolveRoute(s.route, src); ok {
+			srcset, err := s.images.responsive(src, strings.TrimPrefix(p, "/"), width, s.reporter())
+			if err != nil {
+				s.report("image-resize", "<img src=%q> could not be resized: %v", src, err)
+			} else if srcset != "" {
+				setAttr(n, "srcset", srcset)
+				if !hasAttr(n, "sizes") {
+					sizes := s.images.cfg.Sizes
+					if sizes == "" {
+						sizes = "100vw"
+					}
+					setAttr(n, "sizes", sizes)
+				}
+			}
+		}
+	}
+	if !hasAttr(n, "width") && !hasAttr(n, "height") {
+		setAttr(n, "width", strconv.Itoa(width))
+		setAttr(n, "height", strconv.Itoa(height))
+	}
+}
+
+// lazyLoad marks every <img> but the page's first for lazy loading once
+// images: sets widths or a placeholder. The first is likely the largest
+// contentful paint, so it loads eagerly and with high priority instead.
+func (s *processState) lazyLoad(n *html.Node) {
+	if s.images == nil || len(s.images.cfg.Widths) == 0 && s.images.cfg.Placeholder == "" {
+		return
+	}
+	if s.imageCount == 1 {
+		if !hasAttr(n, "fetchpriority") {
+			setAttr(n, "fetchpriority", "high")
+		}
+		return
+	}
+	if !hasAttr(n, "loading") {
+		setAttr(n, "loading", "lazy")
+	}
+	if !hasAttr(n, "decoding") {
+		setAttr(n, "decoding", "async")
+	}
+}
+
+// placeholderCache remembers computed placeholders across dev server
+// rebuilds, keyed by path, modification time and mode.
+var placeholderCache sync.Map
+
+// placeholder gives an opaque local image an inline background to show
+// while it loads: its dominant colour, or a tiny blurred preview.
+func (s *processState) placeholder(n *html.Node, imgPath string) {
+	if s.images == nil || s.images.cfg.Placeholder == "" {
+		return
+	}
+	mode := s.images.cfg.Placeholder
+	// SVG and AVIF are sized from their headers but can't be decoded.
+	if ext := strings.ToLower(filepath.Ext(imgPath)); ext == ".svg" || ext == ".avif" {
+		return
+	}
+	if !validPlaceholder(mode) {
+		// Reported once by checkImages.
+		return
+	}
+	info, err := os.Stat(imgPath)
+	if err != nil {
+		return
+	}
+	key := fmt.Sprintf("%s|%d|%s", imgPath, info.ModTime().UnixNano(), mode)
+	if style, ok := placeholderCache.Load(key); ok {
+		if style != "" {
+			appendStyle(n, style.(string))
+		}
+		return
+	}
+
+	img, err := decodeImage(imgPath)
+	if err != nil {
+		s.report("image-placeholder", "<img src=%q> could not be decoded for a placeholder: %v", getAttr(n, "src"), err)
+		return
+	}
+	style := ""
+	// A placeholder would show through transparent pixels once loaded.
+	if o, ok := img.(interface{ Opaque() bool }); !ok || o.Opaque() {
+		if mode == "color" {
+			style = "background-color: " + dominantColor(img)
+		} else {
+			style, err = blurPlaceholder(img)
+			if err != nil {
+				s.report("image-placeholder", "<img src=%q> placeholder failed: %v", getAttr(n, "src"), err)
+				return
+			}
+		}
+	}
+	placeholderCache.Store(key, style)
+	if style != "" {
+		appendStyle(n, style)
+	}
+}
+
+func validPlaceholder(mode string) bool {
+	return mode == "" || mode == "color" || mode == "blur"
+}
+
+// checkImages reports an images: placeholder mode pager doesn't know, and
+// widths set for a site built in place, which are not resized.
+func checkImages(cfg ImagesConfig, inPlace bool, report reporter) {
+	if !validPlaceholder(cfg.Placeholder) {
+		report("image-placeholder", "images: unknown placeholder %q (use color or blur)", cfg.Placeholder)
+	}
+	if len(cfg.Widths) > 0 && inPlace {
+		report("image-resize", "images: widths needs an out: directory; images are not resized")
+	}
+}
+
+// shrink scales img so its longer side is at most size pixels.
+func shrink(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	w, h := size, size
+	if b.Dx() > b.Dy() {
+		h = max(1, b.Dy()*size/b.Dx())
+	} else {
+		w = max(1, b.Dx()*size/b.Dy())
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// dominantColor averages a downscaled copy of img into one hex colour.
+func dominantColor(img image.Image) string {
+	small := shrink(img, 16)
+	var r, g, b, count int
+	for i := 0; i+3 < len(small.Pix); i += 4 {
+		r += int(small.Pix[i])
+		g += int(small.Pix[i+1])
+		b += int(small.Pix[i+2])
+		count++
+	}
+	if count == 0 {
+		return "transparent"
+	}
+	return fmt.Sprintf("#%02x%02x%02x", r/count, g/count, b/count)
+}
+
+// blurPlaceholder returns a background declaration holding a tiny PNG of
+// img, blurred by an SVG filter so it doesn't look pixelated when stretched.
+func blurPlaceholder(img image.Image) (string, error) {
+	small := shrink(img, 16)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, small); err != nil {
+		return "", err
+	}
+	w, h := small.Bounds().Dx(), small.Bounds().Dy()
+	svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" preserveAspectRatio="none">`+
+		`<filter id="b" color-interpolation-filters="sRGB"><feGaussianBlur stdDeviation="1"/>`+
+		`<feComponentTransfer><feFuncA type="discrete" tableValues="1 1"/></feComponentTransfer></filter>`+
+		`<image filter="url(#b)" width="100%%" height="100%%" preserveAspectRatio="none" href="data:image/png;base64,%s"/></svg>`,
+		w, h, base64.StdEncoding.EncodeToString(buf.Bytes()))
+	return fmt.Sprintf(`background-size: cover; background-image: url(data:image/svg+xml;base64,%s)`,
+		base64.StdEncoding.EncodeToString([]byte(svg))), nil
+}
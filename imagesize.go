@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	_ "golang.org/x/image/webp"
+)
+
+// imageSize returns the pixel dimensions of the image at p. GIF, JPEG, PNG
+// and WebP are read with the image decoders; SVG and AVIF only have their
+// headers parsed.
+func imageSize(p string) (width, height int, ok bool) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".svg":
+		return svgSize(f)
+	case ".avif":
+		return avifSize(io.LimitReader(f, 1<<20))
+	}
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, false
+	}
+	return cfg.Width, cfg.Height, true
+}
+
+// svgSize reads the root <svg> element, preferring absolute width and
+// height attributes and falling back to the viewBox.
+func svgSize(r io.Reader) (int, int, bool) {
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, 0, false
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local != "svg" {
+			return 0, 0, false
+		}
+		var width, height, viewBox string
+		for _, a := range start.Attr {
+			switch a.Name.Local {
+			case "width":
+				width = a.Value
+			case "height":
+				height = a.Value
+			case "viewBox":
+				viewBox = a.Value
+			}
+		}
+		w, wok := svgLength(width)
+		h, hok := svgLength(height)
+		if wok && hok {
+			return w, h, true
+		}
+		fields := strings.FieldsFunc(viewBox, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' })
+		if len(fields) != 4 {
+			return 0, 0, false
+		}
+		vw, err1 := strconv.ParseFloat(fields[2], 64)
+		vh, err2 := strconv.ParseFloat(fields[3], 64)
+		if err1 != nil || err2 != nil || vw <= 0 || vh <= 0 {
+			return 0, 0, false
+		}
+		// Only the width was given: scale the viewBox to it.
+		if wok {
+			return w, max(1, int(math.Round(float64(w)*vh/vw))), true
+		}
+		return max(1, int(math.Round(vw))), max(1, int(math.Round(vh))), true
+	}
+}
+
+// svgLength parses a width or height in user units or pixels. Relative
+// units like % and em say nothing about the image's size.
+func svgLength(v string) (int, bool) {
+	v = strings.TrimSuffix(strings.TrimSpace(v), "px")
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f <= 0 {
+		return 0, false
+	}
+	return max(1, int(math.Round(f))), true
+}
+
+// avifSize finds the image spatial extents ('ispe') property in an AVIF
+// file's meta box. Grid images carry an ispe per tile as well, so the
+// largest one wins. An 'irot' of 90 or 270 degrees swaps the sides.
+func avifSize(r io.Reader) (int, int, bool) {
+	data, err := io.ReadAll(r)
+	if err != nil && len(data) == 0 {
+		return 0, 0, false
+	}
+	var width, height int
+	rotated := false
+	var walk func(b []byte)
+	walk = func(b []byte) {
+		for len(b) >= 8 {
+			size := uint64(binary.BigEndian.Uint32(b))
+			typ := string(b[4:8])
+			header := uint64(8)
+			switch size {
+			case 0:
+				size = uint64(len(b))
+			case 1:
+				if len(b) < 16 {
+					return
+				}
+				size = binary.BigEndian.Uint64(b[8:])
+				header = 16
+			}
+			if size < header || size > uint64(len(b)) {
+				return
+			}
+			body := b[header:size]
+			switch typ {
+			case "ftyp":
+				if !bytes.Contains(body, []byte("avif")) && !bytes.Contains(body, []byte("avis")) {
+					return
+				}
+			case "meta":
+				// meta is a full box: skip its version and flags.
+				if len(body) >= 4 {
+					walk(body[4:])
+				}
+			case "iprp", "ipco":
+				walk(body)
+			case "ispe":
+				if len(body) >= 12 {
+					w := int(binary.BigEndian.Uint32(body[4:]))
+					h := int(binary.BigEndian.Uint32(body[8:]))
+					if w*h > width*height {
+						width, height = w, h
+					}
+				}
+			case "irot":
+				if len(body) >= 1 && body[0]&1 == 1 {
+					rotated = true
+				}
+			}
+			b = b[size:]
+		}
+	}
+	walk(data)
+	if width == 0 || height == 0 {
+		return 0, 0, false
+	}
+	if rotated {
+		width, height = height, width
+	}
+	return width, height, true
+}
@@ -3,8 +3,14 @@ package main
 import (
 	"bytes"
 	"encoding/csv"
+	"errors"
 	"fmt"
+	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/alecthomas/chroma/v2"
@@ -12,13 +18,74 @@ import (
 	"github.com/alecthomas/chroma/v2/lexers"
 	"github.com/alecthomas/chroma/v2/styles"
 	"golang.org/x/net/html"
+	"gopkg.in/yaml.v3"
 )
 
-func csvToTable(data []byte, src string) string {
+// partialsDir is where partials conventionally live. Nothing in it is
+// built as a page.
+const partialsDir = "partials"
+
+var convertTagRe = regexp.MustCompile(`<convert\b[^>]*?/?>(?:</convert>)?`)
+
+// convertFrontMatter reads the front matter of every Markdown file content
+// converts directly, for the page's own {{ .Front }}, merged so that the
+// first file to set a key wins. Files whose src is only known once the
+// page's template has run are skipped, and front matter that doesn't parse
+// is reported once the file is converted.
+func convertFrontMatter(dir, content string) map[string]any {
+	merged := make(map[string]any)
+	for _, tag := range convertTagRe.FindAllString(content, -1) {
+		src := tagAttrs(tag)["src"]
+		if strings.ToLower(filepath.Ext(src)) != ".md" || strings.Contains(src, "{{") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, src))
+		if err != nil {
+			continue
+		}
+		front, _ := splitFrontMatter(data)
+		keys, _, err := markdownFrontMatter(src, front)
+		if err != nil {
+			continue
+		}
+		mergeFront(merged, keys)
+	}
+	return merged
+}
+
+// markdownFrontMatter parses the front matter of the Markdown file src. If
+// it doesn't parse, the returned position points at the problem.
+func markdownFrontMatter(src string, front []byte) (map[string]any, position, error) {
+	if len(front) == 0 {
+		return nil, position{}, nil
+	}
+	var keys map[string]any
+	if err := yaml.Unmarshal(front, &keys); err != nil {
+		file := strings.TrimPrefix(filepath.ToSlash(src), "/")
+		pos, msg := position{File: file}, err.Error()
+		if m := yamlErrLineRe.FindStringSubmatch(msg); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			pos, msg = position{File: file, Line: line + 1}, m[2]
+		}
+		return nil, pos, errors.New(msg)
+	}
+	return keys, position{}, nil
+}
+
+// mergeFront adds the keys of front that merged doesn't have yet.
+func mergeFront(merged, front map[string]any) {
+	for k, v := range front {
+		if _, ok := merged[k]; !ok {
+			merged[k] = v
+		}
+	}
+}
+
+func csvToTable(data []byte, src string, report reporter) string {
 	reader := csv.NewReader(bytes.NewReader(data))
 	records, err := reader.ReadAll()
 	if err != nil {
-		warn("<include src=%q> failed to parse CSV: %v", src, err)
+		report("convert", "<convert src=%q> failed to parse CSV: %v", src, err)
 		return ""
 	}
 	if len(records) == 0 {
@@ -45,33 +112,59 @@ func csvToTable(data []byte, src string) string {
 	return sb.String()
 }
 
-func highlightCode(data []byte, src string) string {
-	ext := filepath.Ext(src)
+// highlightCode highlights code from src with a <syntax> tag's options.
+// numbers holds the line number in src of each line of code.
+func highlightCode(code, src string, numbers []int, opts syntaxOptions, report reporter) string {
+	lang := strings.TrimPrefix(filepath.Ext(src), ".")
 	lexer := lexers.Match(src)
+	if opts.lang != "" {
+		if l := lexers.Get(opts.lang); l != nil {
+			lexer, lang = l, opts.lang
+		} else {
+			report("syntax", "<syntax src=%q> has unknown lang %q", src, opts.lang)
+		}
+	}
 	if lexer == nil {
 		lexer = lexers.Fallback
 	}
 	lexer = chroma.Coalesce(lexer)
 
+	// chroma numbers lines consecutively, so highlights are placed by
+	// their position in code rather than their line in the file.
+	first := 1
+	if len(numbers) > 0 {
+		first = numbers[0]
+	}
+	var highlight [][2]int
+	for i, n := range numbers {
+		if opts.highlighted(n) {
+			highlight = append(highlight, [2]int{first + i, first + i})
+		}
+	}
+
 	formatter := chromahtml.New(
 		chromahtml.WithClasses(true),
 		chromahtml.PreventSurroundingPre(false),
+		chromahtml.WithLineNumbers(opts.lineNumbers),
+		chromahtml.BaseLineNumber(first),
+		chromahtml.HighlightLines(highlight),
 	)
 
-	iterator, err := lexer.Tokenise(nil, string(data))
+	iterator, err := lexer.Tokenise(nil, code)
 	if err != nil {
-		warn("<syntax src=%q> failed to tokenize: %v", src, err)
-		lang := strings.TrimPrefix(ext, ".")
-		return fmt.Sprintf("<pre><code class=\"language-%s\">%s</code></pre>", lang, html.EscapeString(string(data)))
+		report("syntax", "<syntax src=%q> failed to tokenize: %v", src, err)
+		return opts.wrap(fmt.Sprintf("<pre><code class=\"language-%s\">%s</code></pre>", lang, html.EscapeString(code)))
 	}
 
 	var buf bytes.Buffer
 	if err := formatter.Format(&buf, styles.Fallback, iterator); err != nil {
-		warn("<syntax src=%q> failed to format: %v", src, err)
-		lang := strings.TrimPrefix(ext, ".")
-		return fmt.Sprintf("<pre><code class=\"language-%s\">%s</code></pre>", lang, html.EscapeString(string(data)))
+		report("syntax", "<syntax src=%q> failed to format: %v", src, err)
+		return opts.wrap(fmt.Sprintf("<pre><code class=\"language-%s\">%s</code></pre>", lang, html.EscapeString(code)))
 	}
-	return buf.String()
+	if opts.lineNumbers {
+		return opts.wrap(renumberLines(buf.String(), numbers))
+	}
+	return opts.wrap(buf.String())
 }
 
 // syntaxThemeCSS returns the chroma CSS for the given theme name, or "" if not found.
@@ -104,3 +197,104 @@ func syntaxThemeDarkCSS(theme string) string {
 	sb.WriteString("}\n")
 	return sb.String()
 }
+
+var (
+	includeTagRe   = regexp.MustCompile(`<include\b[^>]*>|</include\s*>`)
+	includeParamRe = regexp.MustCompile(`\{\{\s*\.([A-Za-z_][\w-]*)\s*\}\}`)
+	slotRe         = regexp.MustCompile(`(?s)<slot\b[^>]*?/>|<slot\b[^>]*>(.*?)</slot\s*>`)
+)
+
+// expandIncludes replaces every <include src="..."> in content, which came
+// from the file from, with the partial it names. stack holds the files
+// being included, outermost first, to catch cycles.
+func (s *processState) expandIncludes(content, from string, stack []string) string {
+	locs := includeTagRe.FindAllStringIndex(content, -1)
+	if len(locs) == 0 {
+		return content
+	}
+	ignored := ignoredByTag(content)
+	var out strings.Builder
+	last := 0
+	for i := 0; i < len(locs); i++ {
+		start, end := locs[i][0], locs[i][1]
+		tag := content[start:end]
+		if strings.HasPrefix(tag, "</") {
+			continue
+		}
+		// An <include> holds everything up to its matching </include>, or
+		// nothing if it closes itself or is never closed.
+		inner, next := "", end
+		if !strings.HasSuffix(tag, "/>") {
+			depth := 1
+			for j := i + 1; j < len(locs); j++ {
+				t := content[locs[j][0]:locs[j][1]]
+				switch {
+				case strings.HasPrefix(t, "</"):
+					depth--
+				case !strings.HasSuffix(t, "/>"):
+					depth++
+				}
+				if depth == 0 {
+					inner, next = content[end:locs[j][0]], locs[j][1]
+					i = j
+					break
+				}
+			}
+		}
+		out.WriteString(content[last:start])
+		out.WriteString(s.include(tag, inner, from, stack, s.tagReporter(tagAttrs(tag), ignored)))
+		last = next
+	}
+	out.WriteString(content[last:])
+	return out.String()
+}
+
+// include returns the partial named by an <include> tag, with its
+// {{ .name }} placeholders replaced by the tag's attributes and its <slot>
+// by inner, the tag's content. src resolves against the including file, or
+// against the site root if it starts with "/". Problems are reported with
+// report.
+func (s *processState) include(tag, inner, from string, stack []string, report reporter) string {
+	attrs := tagAttrs(tag)
+	src := attrs["src"]
+	if src == "" {
+		report("attr-empty", "<include> has empty src attribute")
+		return ""
+	}
+	rel := path.Join(path.Dir(from), src)
+	if strings.HasPrefix(src, "/") {
+		rel = path.Clean(strings.TrimPrefix(src, "/"))
+	}
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		report("file-missing", "<include src=%q> points outside the site", src)
+		return ""
+	}
+	if slices.Contains(stack, rel) {
+		report("include-cycle", "<include src=%q> includes itself: %s", src, strings.Join(append(slices.Clone(stack), rel), " → "))
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, filepath.FromSlash(rel)))
+	if err != nil {
+		report("file-missing", "<include src=%q> references missing file", src)
+		return ""
+	}
+
+	partial := annotatePositions(string(data), rel, 0)
+	partial = includeParamRe.ReplaceAllStringFunc(partial, func(m string) string {
+		name := strings.ToLower(includeParamRe.FindStringSubmatch(m)[1])
+		val, ok := attrs[name]
+		if !ok {
+			report("include", "<include src=%q> doesn't set %s, which %s uses", src, name, rel)
+		}
+		return html.EscapeString(val)
+	})
+	inner = s.expandIncludes(inner, from, stack)
+	partial = slotRe.ReplaceAllStringFunc(partial, func(m string) string {
+		if strings.TrimSpace(inner) == "" {
+			// Fall back to the slot's own content.
+			return slotRe.FindStringSubmatch(m)[1]
+		}
+		return inner
+	})
+	return s.expandIncludes(partial, rel, append(slices.Clone(stack), rel))
+}
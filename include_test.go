@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"testing"
+)
+
+var posAttrRe = regexp.MustCompile(` ` + posAttr + `="[^"]*"`)
+
+func TestExpandIncludes(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"partials/card.html":  `<div class="{{ .kind }}"><h3>{{ .title }}</h3><slot><p>empty</p></slot></div>`,
+		"partials/outer.html": `<section><include src="card.html" title="{{ .title }}" kind="inner">{{ .title }}</include></section>`,
+		"partials/loop.html":  `<include src="/partials/loop.html" />`,
+		"blog/note.html":      `<em>{{ .who }}</em>`,
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name, from, in, want string
+		rules                []string
+	}{
+		{
+			name: "parameters and slot",
+			from: "pager.html",
+			in:   `<include src="partials/card.html" title="A &amp; B" kind="wide"><p>body</p></include>`,
+			want: `<div class="wide"><h3>A &amp; B</h3><p>body</p></div>`,
+		},
+		{
+			name: "slot fallback",
+			from: "pager.html",
+			in:   `<include src="/partials/card.html" title="T" kind="k" />`,
+			want: `<div class="k"><h3>T</h3><p>empty</p></div>`,
+		},
+		{
+			name: "nested, relative to the partial",
+			from: "pager.html",
+			in:   `<include src="partials/outer.html" title="T"></include>`,
+			want: `<section><div class="inner"><h3>T</h3>T</div></section>`,
+		},
+		{
+			name: "relative to the page",
+			from: "blog/pager.html",
+			in:   `<p><include src="note.html" who="me"></include></p>`,
+			want: `<p><em>me</em></p>`,
+		},
+		{
+			name:  "missing parameter",
+			from:  "pager.html",
+			in:    `<include src="partials/card.html" title="T"></include>`,
+			want:  `<div class=""><h3>T</h3><p>empty</p></div>`,
+			rules: []string{"include"},
+		},
+		{
+			name:  "missing file",
+			from:  "pager.html",
+			in:    `a<include src="partials/none.html"></include>b`,
+			want:  `ab`,
+			rules: []string{"file-missing"},
+		},
+		{
+			name:  "outside the site",
+			from:  "pager.html",
+			in:    `<include src="../secret.html" />`,
+			rules: []string{"file-missing"},
+		},
+		{
+			name:  "cycle",
+			from:  "pager.html",
+			in:    `<include src="partials/loop.html" />`,
+			rules: []string{"include-cycle"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			diags := newDiagnostics(true)
+			s := newProcessState(dir, page{src: tt.from}, diags)
+			in := annotatePositions(tt.in, tt.from, 0)
+			got := posAttrRe.ReplaceAllString(s.expandIncludes(in, tt.from, []string{tt.from}), "")
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			var rules []string
+			for _, d := range diags.items {
+				rules = append(rules, d.Rule)
+			}
+			if !slices.Equal(rules, tt.rules) {
+				t.Errorf("reported %v, want %v", rules, tt.rules)
+			}
+		})
+	}
+}
+
+func TestMarkdownFrontMatter(t *testing.T) {
+	for _, tt := range []struct {
+		name, in string
+		want     map[string]any
+		pos      position
+	}{
+		{"none", "# Title\n", nil, position{}},
+		{"keys", "---\ntitle: Hello\ntags: [a, b]\n---\n# Title\n", map[string]any{"title": "Hello", "tags": []any{"a", "b"}}, position{}},
+		{"bad yaml", "---\ntitle: Hello\nauthor: Ada: Lovelace\n---\n", nil, position{File: "md/post.md", Line: 3}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			front, _ := splitFrontMatter([]byte(tt.in))
+			got, pos, err := markdownFrontMatter("/md/post.md", front)
+			if (err != nil) != (tt.pos.File != "") || pos != tt.pos {
+				t.Errorf("got error %v at %v, want one at %v", err, pos, tt.pos)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertFrontMatter(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a.md":   "---\ntitle: A\nauthor: Ada\n---\nbody",
+		"b.md":   "---\ntitle: B\nlang: en\n---\nbody",
+		"bad.md": "---\ntitle: [\n---\n",
+		"t.csv":  "a,b\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := `<convert src="bad.md"></convert><convert src="a.md"/><convert src="t.csv"/>` +
+		`<convert src="{{ .Data.md }}"/><convert src="missing.md"/><convert src="b.md"></convert>`
+	got := convertFrontMatter(dir, content)
+	// The first file to set a key wins.
+	if want := "map[author:Ada lang:en title:A]"; fmt.Sprint(got) != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"text/template/parse"
+)
+
+// layouts parses page templates once per build: the embedded template.html
+// and any custom template: files, keyed by path ("" for the embedded one).
+type layouts struct {
+	dir    string
+	diags  *diagnostics
+	parsed map[string]*template.Template
+}
+
+func newLayouts(dir string, diags *diagnostics) *layouts {
+	return &layouts{dir: dir, diags: diags, parsed: make(map[string]*template.Template)}
+}
+
+// get returns the page template for a page's template: setting. A custom
+// template that fails to parse fails the build with its file and line.
+func (l *layouts) get(name string) (*template.Template, error) {
+	if tmpl, ok := l.parsed[name]; ok {
+		return tmpl, nil
+	}
+	if name == "" {
+		tmpl, err := template.New("page").Parse(templateHTML)
+		if err != nil {
+			return nil, fmt.Errorf("template: %w", err)
+		}
+		l.parsed[name] = tmpl
+		return tmpl, nil
+	}
+
+	rel := layoutPath(name)
+	source, err := os.ReadFile(filepath.Join(l.dir, filepath.FromSlash(rel)))
+	if err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+	tmpl, err := template.New(rel).Parse(string(source))
+	if err != nil {
+		pos, msg := templateError(err, rel, 0)
+		return nil, fmt.Errorf("%s: %s", pos, msg)
+	}
+	if !slices.ContainsFunc(tmpl.Templates(), func(t *template.Template) bool { return t.Tree != nil && usesField(t.Tree.Root, "Content") }) {
+		l.diags.report("template-content", position{File: rel}, "%s never outputs {{ .Content }}, so pages built with it are empty", rel)
+	}
+	l.parsed[name] = tmpl
+	return tmpl, nil
+}
+
+// layoutPath returns the slash-separated path of a template: file within
+// the site dir.
+func layoutPath(name string) string {
+	rel := path.Clean(filepath.ToSlash(name))
+	if len(rel) > 1 && rel[0] == '/' {
+		rel = rel[1:]
+	}
+	return rel
+}
+
+// layoutSource returns the markup of a custom template: file, for finding
+// the classes and ids it uses. It returns "" for the built-in template and
+// for files that can't be read, which fail the build when the page is
+// rendered.
+func layoutSource(dir, name string) string {
+	if name == "" {
+		return ""
+	}
+	source, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(layoutPath(name))))
+	if err != nil {
+		return ""
+	}
+	return string(source)
+}
+
+// usesField reports whether the template tree under n refers to .name or
+// $.name anywhere, including in conditions and range or with blocks.
+func usesField(n parse.Node, name string) bool {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Nodes {
+			if usesField(c, name) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return usesField(n.Pipe, name)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if usesField(cmd, name) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if usesField(arg, name) {
+				return true
+			}
+		}
+	case *parse.FieldNode:
+		return len(n.Ident) > 0 && n.Ident[0] == name
+	case *parse.VariableNode:
+		return len(n.Ident) > 1 && n.Ident[0] == "$" && n.Ident[1] == name
+	case *parse.ChainNode:
+		return usesField(n.Node, name)
+	case *parse.IfNode:
+		return usesField(n.Pipe, name) || usesField(n.List, name) || usesField(n.ElseList, name)
+	case *parse.RangeNode:
+		return usesField(n.Pipe, name) || usesField(n.List, name) || usesField(n.ElseList, name)
+	case *parse.WithNode:
+		return usesField(n.Pipe, name) || usesField(n.List, name) || usesField(n.ElseList, name)
+	case *parse.TemplateNode:
+		return usesField(n.Pipe, name)
+	}
+	return false
+}
+
+// eject writes the embedded page template to file, as a starting point for
+// a custom template:. It never overwrites an existing file.
+func eject(file string) error {
+	if _, err := os.Stat(file); err == nil {
+		return fmt.Errorf("%s already exists", file)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if dir := filepath.Dir(file); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(file, []byte(templateHTML), 0644)
+}
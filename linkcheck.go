@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const linkCacheFile = ".pager-cache/links.json"
+
+// LinkCheckConfig tunes `pager check --external`. Zero values fall back to
+// the defaults in newLinkChecker.
+type LinkCheckConfig struct {
+	Concurrency int           `yaml:"concurrency"`
+	Timeout     time.Duration `yaml:"timeout"`
+	HostDelay   time.Duration `yaml:"host_delay"`
+	TTL         time.Duration `yaml:"ttl"`
+}
+
+// linkResult is the outcome of checking one external URL.
+type linkResult struct {
+	Status    int       `json:"status,omitempty"`
+	Final     string    `json:"final,omitempty"` // URL after following redirects
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// linkChecker requests external URLs with bounded concurrency, spacing out
+// requests to the same host, and remembers results in a cache file.
+type linkChecker struct {
+	client      *http.Client
+	concurrency int
+	hostDelay   time.Duration
+	ttl         time.Duration
+	cachePath   string
+	report      reporter // for a cache file that doesn't parse
+
+	mu       sync.Mutex
+	hostNext map[string]time.Time
+	cache    map[string]linkResult
+}
+
+func newLinkChecker(dir string, cfg LinkCheckConfig, report reporter) *linkChecker {
+	c := &linkChecker{
+		client:      &http.Client{Timeout: cfg.Timeout},
+		concurrency: cfg.Concurrency,
+		hostDelay:   cfg.HostDelay,
+		ttl:         cfg.TTL,
+		cachePath:   filepath.Join(dir, linkCacheFile),
+		report:      report,
+		hostNext:    make(map[string]time.Time),
+	}
+	if c.client.Timeout <= 0 {
+		c.client.Timeout = 10 * time.Second
+	}
+	if c.concurrency <= 0 {
+		c.concurrency = 8
+	}
+	if c.hostDelay <= 0 {
+		c.hostDelay = 200 * time.Millisecond
+	}
+	if c.ttl <= 0 {
+		c.ttl = 24 * time.Hour
+	}
+	return c
+}
+
+func (c *linkChecker) loadCache() {
+	c.cache = make(map[string]linkResult)
+	data, err := os.ReadFile(c.cachePath)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &c.cache); err != nil {
+		c.report("cache", "ignoring unreadable link cache: %v", err)
+		c.cache = make(map[string]linkResult)
+	}
+}
+
+func (c *linkChecker) saveCache() error {
+	if err := os.MkdirAll(filepath.Dir(c.cachePath), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c.cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.cachePath, data, 0644)
+}
+
+// checkAll checks every URL in refs once and reports problems at every place
+// the URL is used.
+func (c *linkChecker) checkAll(refs map[string][]reporter) error {
+	c.loadCache()
+
+	urls := make([]string, 0, len(refs))
+	for u := range refs {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+
+	results := make(map[string]linkResult, len(urls))
+	var resultsMu sync.Mutex
+	sem := make(chan struct{}, c.concurrency)
+	var wg sync.WaitGroup
+	for _, u := range urls {
+		c.mu.Lock()
+		cached, ok := c.cache[u]
+		c.mu.Unlock()
+		if ok && time.Since(cached.CheckedAt) < c.ttl {
+			resultsMu.Lock()
+			results[u] = cached
+			resultsMu.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(u string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res := c.check(u)
+			resultsMu.Lock()
+			results[u] = res
+			resultsMu.Unlock()
+			if res.Error == "" {
+				c.mu.Lock()
+				c.cache[u] = res
+				c.mu.Unlock()
+			}
+		}(u)
+	}
+	wg.Wait()
+
+	for _, u := range urls {
+		res := results[u]
+		for _, report := range refs[u] {
+			switch {
+			case res.Error != "":
+				report("link-unreachable", "%s could not be reached: %s", u, res.Error)
+			case res.Status >= 400:
+				report("link-broken", "%s returned %d %s", u, res.Status, http.StatusText(res.Status))
+			case res.Final != "" && res.Final != u:
+				report("link-redirect", "%s redirects to %s", u, res.Final)
+			}
+		}
+	}
+	return c.saveCache()
+}
+
+// check requests u with HEAD, falling back to GET for servers that reject
+// HEAD requests.
+func (c *linkChecker) check(u string) linkResult {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return linkResult{Error: err.Error(), CheckedAt: time.Now()}
+	}
+	c.waitForHost(parsed.Host)
+	res, err := c.request(http.MethodHead, u)
+	if err != nil || res.Status == http.StatusMethodNotAllowed || res.Status == http.StatusNotImplemented || res.Status == http.StatusForbidden {
+		c.waitForHost(parsed.Host)
+		res, err = c.request(http.MethodGet, u)
+	}
+	if err != nil {
+		return linkResult{Error: err.Error(), CheckedAt: time.Now()}
+	}
+	return res
+}
+
+func (c *linkChecker) request(method, u string) (linkResult, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return linkResult{}, err
+	}
+	req.Header.Set("User-Agent", "pager-link-check")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return linkResult{}, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	res := linkResult{Status: resp.StatusCode, CheckedAt: time.Now()}
+	if final := resp.Request.URL.String(); final != u {
+		res.Final = final
+	}
+	return res, nil
+}
+
+// waitForHost blocks until the host's next request slot, so no host sees
+// requests closer together than hostDelay.
+func (c *linkChecker) waitForHost(host string) {
+	c.mu.Lock()
+	now := time.Now()
+	next := c.hostNext[host]
+	if next.Before(now) {
+		next = now
+	}
+	c.hostNext[host] = next.Add(c.hostDelay)
+	c.mu.Unlock()
+	time.Sleep(time.Until(next))
+}
+
+// isExternalURL reports whether ref is an absolute http(s) URL worth checking.
+func isExternalURL(ref string) bool {
+	return strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://")
+}
+
+// cssExternalRefs returns the absolute URLs a local stylesheet references,
+// each with its position in the file.
+func cssExternalRefs(dir, css string) map[string]position {
+	refs := make(map[string]position)
+	file := strings.TrimPrefix(css, "/")
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(file)))
+	if err != nil {
+		return refs
+	}
+	for _, m := range cssRefRe.FindAllSubmatchIndex(data, -1) {
+		start, end := m[2], m[3]
+		if start < 0 {
+			start, end = m[4], m[5]
+		}
+		ref := string(data[start:end])
+		if !isExternalURL(ref) {
+			continue
+		}
+		if _, ok := refs[ref]; !ok {
+			line, col := lineCol(data, m[0])
+			refs[ref] = position{File: file, Line: line, Col: col}
+		}
+	}
+	return refs
+}
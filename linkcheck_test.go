@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// reports collects what a reporter is called with, as "rule: message".
+type reports struct {
+	mu  sync.Mutex
+	got []string
+}
+
+func (r *reports) reporter() reporter {
+	return func(rule, format string, args ...any) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.got = append(r.got, rule+": "+fmt.Sprintf(format, args...))
+	}
+}
+
+func (r *reports) rules() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var rules []string
+	for _, g := range r.got {
+		rule, _, _ := strings.Cut(g, ":")
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// testLinkChecker returns a checker with a cache in a temporary site dir
+// that requests through srv's client.
+func testLinkChecker(t *testing.T, srv *httptest.Server, cfg LinkCheckConfig) *linkChecker {
+	t.Helper()
+	if cfg.HostDelay == 0 {
+		cfg.HostDelay = time.Millisecond
+	}
+	c := newLinkChecker(t.TempDir(), cfg, func(rule, format string, args ...any) {
+		t.Errorf("unexpected report %s: %s", rule, fmt.Sprintf(format, args...))
+	})
+	c.client = srv.Client()
+	return c
+}
+
+func TestLinkCheckHeadFallback(t *testing.T) {
+	for _, status := range []int{http.StatusMethodNotAllowed, http.StatusNotImplemented, http.StatusForbidden} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			var mu sync.Mutex
+			var methods []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				methods = append(methods, r.Method)
+				mu.Unlock()
+				if r.Method == http.MethodHead {
+					w.WriteHeader(status)
+				}
+			}))
+			defer srv.Close()
+
+			var r reports
+			c := testLinkChecker(t, srv, LinkCheckConfig{})
+			if err := c.checkAll(map[string][]reporter{srv.URL + "/page": {r.reporter()}}); err != nil {
+				t.Fatal(err)
+			}
+			if len(r.got) > 0 {
+				t.Errorf("got reports %q, want none", r.got)
+			}
+			if want := []string{http.MethodHead, http.MethodGet}; fmt.Sprint(methods) != fmt.Sprint(want) {
+				t.Errorf("requests = %v, want %v", methods, want)
+			}
+		})
+	}
+}
+
+func TestLinkCheckStatuses(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.HandleFunc("/failing", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	mux.Handle("/old", http.RedirectHandler("/ok", http.StatusMovedPermanently))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		path string
+		want string // the rule reported, or "" for none
+		msg  string
+	}{
+		{"/ok", "", ""},
+		{"/missing", "link-broken", "returned 404 Not Found"},
+		{"/failing", "link-broken", "returned 503 Service Unavailable"},
+		{"/old", "link-redirect", "redirects to " + srv.URL + "/ok"},
+	}
+	refs := make(map[string][]reporter)
+	got := make(map[string]*reports)
+	for _, tt := range tests {
+		got[tt.path] = &reports{}
+		refs[srv.URL+tt.path] = []reporter{got[tt.path].reporter()}
+	}
+	c := testLinkChecker(t, srv, LinkCheckConfig{})
+	if err := c.checkAll(refs); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		r := got[tt.path]
+		switch {
+		case tt.want == "" && len(r.got) > 0:
+			t.Errorf("%s: got %q, want no reports", tt.path, r.got)
+		case tt.want != "" && len(r.got) != 1:
+			t.Errorf("%s: got %q, want one %s", tt.path, r.got, tt.want)
+		case tt.want != "" && (!strings.HasPrefix(r.got[0], tt.want+":") || !strings.Contains(r.got[0], tt.msg)):
+			t.Errorf("%s: got %q, want %s containing %q", tt.path, r.got[0], tt.want, tt.msg)
+		}
+	}
+}
+
+func TestLinkCheckUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	u := srv.URL + "/gone"
+	srv.Close()
+
+	var r reports
+	c := testLinkChecker(t, srv, LinkCheckConfig{Timeout: time.Second})
+	if err := c.checkAll(map[string][]reporter{u: {r.reporter()}}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"link-unreachable"}; fmt.Sprint(r.rules()) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %v", r.got, want)
+	}
+	// Failures aren't cached, so the next check tries again.
+	if _, ok := c.cache[u]; ok {
+		t.Errorf("unreachable URL was cached")
+	}
+}
+
+func TestLinkCheckCache(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	fresh, stale := srv.URL+"/fresh", srv.URL+"/stale"
+	c := testLinkChecker(t, srv, LinkCheckConfig{TTL: time.Hour})
+	cached := map[string]linkResult{
+		fresh: {Status: http.StatusNotFound, CheckedAt: time.Now().Add(-time.Minute)},
+		stale: {Status: http.StatusOK, CheckedAt: time.Now().Add(-2 * time.Hour)},
+	}
+	data, err := json.Marshal(cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.cachePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(c.cachePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var freshReports, staleReports reports
+	refs := map[string][]reporter{
+		fresh: {freshReports.reporter()},
+		stale: {staleReports.reporter()},
+	}
+	if err := c.checkAll(refs); err != nil {
+		t.Fatal(err)
+	}
+	if hits["/fresh"] != 0 {
+		t.Errorf("fresh cached URL was requested %d times", hits["/fresh"])
+	}
+	if hits["/stale"] == 0 {
+		t.Errorf("expired cached URL was not requested again")
+	}
+	// The fresh entry reports its cached 404; the expired one was fetched
+	// again and now 404s too.
+	for name, r := range map[string]*reports{"fresh": &freshReports, "stale": &staleReports} {
+		if want := []string{"link-broken"}; fmt.Sprint(r.rules()) != fmt.Sprint(want) {
+			t.Errorf("%s: got %q, want %v", name, r.got, want)
+		}
+	}
+
+	// The new result is written back for the next run.
+	data, err = os.ReadFile(c.cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]linkResult
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if got := saved[stale]; got.Status != http.StatusNotFound || time.Since(got.CheckedAt) > time.Minute {
+		t.Errorf("saved %s = %+v, want a fresh 404", stale, got)
+	}
+}
+
+func TestLinkCheckHostDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	var mu sync.Mutex
+	var times []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	refs := make(map[string][]reporter)
+	for i := range 4 {
+		refs[fmt.Sprintf("%s/%d", srv.URL, i)] = nil
+	}
+	c := testLinkChecker(t, srv, LinkCheckConfig{Concurrency: 4, HostDelay: delay})
+	if err := c.checkAll(refs); err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != len(refs) {
+		t.Fatalf("got %d requests, want %d", len(times), len(refs))
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	for i := 1; i < len(times); i++ {
+		// Allow for the time between a slot opening and the request arriving.
+		if gap := times[i].Sub(times[i-1]); gap < delay-10*time.Millisecond {
+			t.Errorf("requests %d and %d were %s apart, want at least %s", i-1, i, gap, delay)
+		}
+	}
+}
+
+// TestExternalLinksEndToEnd checks links found in a page's content the way
+// pager check --external does. Links to localhost are reported rather than
+// checked, so the page links to a made-up host that the checker's client
+// dials the local server for.
+func TestExternalLinksEndToEnd(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/missing", http.NotFound)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	p := page{src: "index.html", route: "/"}
+	diags := newDiagnostics(true)
+	state := newProcessState(dir, p, diags)
+	content := "<p><a href=\"http://pager.test/ok\">fine</a>\n<a href=\"http://pager.test/missing\">broken</a></p>\n"
+	processContent(annotatePositions(content, p.src, 0), state)
+
+	c := testLinkChecker(t, srv, LinkCheckConfig{})
+	c.client.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+	}
+	if err := c.checkAll(externalRefs(dir, []*pageBuild{{page: p, state: state}})); err != nil {
+		t.Fatal(err)
+	}
+	if len(diags.items) != 1 {
+		t.Fatalf("got %+v, want one diagnostic", diags.items)
+	}
+	got := diags.items[0]
+	if got.Rule != "link-broken" || got.Severity != severityError || got.Line != 2 || !strings.Contains(got.Message, "/missing") {
+		t.Errorf("got %+v, want a link-broken error for /missing at line 2", got)
+	}
+	if _, err := os.Stat(c.cachePath); err != nil {
+		t.Errorf("link cache not written: %v", err)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"html/template"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -28,18 +30,35 @@ func buildFail(err error) {
 }
 
 type Config struct {
-	Title       string   `yaml:"title"`
-	Description string   `yaml:"description"`
-	Favicon     string   `yaml:"favicon"`
-	Card        string   `yaml:"card"`
-	Domain      string   `yaml:"domain"`
-	Port        int      `yaml:"port"`
-	CSS         []string `yaml:"css"`
-	Tailwind    bool     `yaml:"tailwind"`
-	InlineCSS   bool     `yaml:"inline_css"`
-	Inject      string   `yaml:"inject"`
-	Theme       string   `yaml:"theme"`
-	Deploy      string   `yaml:"deploy"`
+	Title       string            `yaml:"title"`
+	Description string            `yaml:"description"`
+	Favicon     string            `yaml:"favicon"`
+	Card        string            `yaml:"card"`
+	Domain      string            `yaml:"domain"`
+	Port        int               `yaml:"port"`
+	CSS         []string          `yaml:"css"`
+	Tailwind    bool              `yaml:"tailwind"`
+	InlineCSS   bool              `yaml:"inline_css"`
+	BundleCSS   bool              `yaml:"bundle_css"`
+	PurgeCSS    bool              `yaml:"purge_css"`
+	Safelist    []string          `yaml:"purge_safelist"`
+	JS          []string          `yaml:"js"`
+	InlineJS    bool              `yaml:"inline_js"`
+	ModuleJS    bool              `yaml:"remote_js_module"`
+	Minify      bool              `yaml:"minify"`
+	Inject      string            `yaml:"inject"`
+	Theme       string            `yaml:"theme"`
+	Deploy      string            `yaml:"deploy"`
+	Out         string            `yaml:"out"`
+	Lint        map[string]string `yaml:"lint"`
+	LinkCheck   LinkCheckConfig   `yaml:"link_check"`
+	Images      ImagesConfig      `yaml:"images"`
+	HashAssets  bool              `yaml:"hash_assets"`
+	SRI         bool              `yaml:"sri"`
+	CSP         CSPConfig         `yaml:"csp"`
+	Data        map[string]any    `yaml:"data"`
+	Template    string            `yaml:"template"`
+	Markdown    MarkdownConfig    `yaml:"markdown"`
 }
 
 type heading struct {
@@ -49,15 +68,44 @@ type heading struct {
 }
 
 type PageData struct {
-	Title        string
-	Description  string
-	Favicon      string
-	Card         string
-	Site         struct{ Domain string }
-	CSS          []string
-	InlineStyles []template.CSS
-	Inject       template.HTML
-	Content      template.HTML
+	Title         string
+	Description   string
+	Favicon       string
+	Card          string
+	Route         string
+	URL           string
+	Site          struct{ Domain string }
+	CSS           []assetLink
+	InlineStyles  []template.CSS
+	Scripts       []assetLink
+	InlineScripts []template.JS
+	Front         map[string]any // front matter of converted Markdown files
+	Inject        template.HTML
+	Content       template.HTML
+}
+
+// parseBuildFlags reads the flags shared by build, deploy and the dev server.
+func parseBuildFlags(args []string) buildOptions {
+	var opts buildOptions
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--out" && i+1 < len(args):
+			opts.out = args[i+1]
+			i++
+		case strings.HasPrefix(args[i], "--out="):
+			opts.out = strings.TrimPrefix(args[i], "--out=")
+		case args[i] == "--format" && i+1 < len(args):
+			opts.format = args[i+1]
+			i++
+		case strings.HasPrefix(args[i], "--format="):
+			opts.format = strings.TrimPrefix(args[i], "--format=")
+		case args[i] == "--strict":
+			opts.strict = true
+		case args[i] == "--external":
+			opts.external = true
+		}
+	}
+	return opts
 }
 
 func main() {
@@ -80,8 +128,28 @@ func main() {
 		return
 	}
 
+	if len(os.Args) >= 2 && os.Args[1] == "eject" {
+		target := "template.html"
+		if len(os.Args) >= 3 {
+			target = os.Args[2]
+		}
+		if len(os.Args) > 3 {
+			log.Fatal("usage: pager eject [file]")
+		}
+		if err := eject(target); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Wrote the page template to %s; set template: %s in pager.yaml to use it", target, filepath.ToSlash(target))
+		return
+	}
+
 	if len(os.Args) >= 2 && os.Args[1] == "build" {
-		if err := build("."); err != nil {
+		opts := parseBuildFlags(os.Args[2:])
+		result, err := buildSite(".", opts)
+		if opts.format == "json" {
+			result.diags.writeJSON(os.Stdout)
+		}
+		if err != nil {
 			buildFail(err)
 			os.Exit(1)
 		}
@@ -89,8 +157,26 @@ func main() {
 		return
 	}
 
+	if len(os.Args) >= 2 && os.Args[1] == "check" {
+		opts := parseBuildFlags(os.Args[2:])
+		opts.check = true
+		result, err := buildSite(".", opts)
+		if opts.format == "json" {
+			result.diags.writeJSON(os.Stdout)
+		}
+		if err != nil {
+			buildFail(err)
+			os.Exit(1)
+		}
+		log.Printf("Checked site: %s", result.diags.summary())
+		if errs, _ := result.diags.counts(); errs > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(os.Args) >= 2 && os.Args[1] == "deploy" {
-		if err := deploy("."); err != nil {
+		if err := deploy(".", parseBuildFlags(os.Args[2:])); err != nil {
 			log.Fatal(err)
 		}
 		return
@@ -115,7 +201,7 @@ func main() {
 	if port == 0 {
 		port = 8080
 	}
-	if err := run(".", port); err != nil {
+	if err := run(".", port, parseBuildFlags(os.Args[1:])); err != nil {
 		buildFail(err)
 		os.Exit(1)
 	}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// assetManifest maps local assets to content-hashed names like
+// style.1a2b3c4d.css, so the output can be served with immutable cache
+// headers. Stylesheets are hashed after their own url()s are rewritten, so
+// changing a font also renames every stylesheet that uses it.
+type assetManifest struct {
+	dir     string
+	names   map[string]string // site-relative path → hashed path
+	content map[string][]byte // rewritten stylesheets, by site-relative path
+	pending map[string]bool   // stylesheets being rewritten, to break @import cycles
+}
+
+func newAssetManifest(dir string) *assetManifest {
+	return &assetManifest{
+		dir:     dir,
+		names:   make(map[string]string),
+		content: make(map[string][]byte),
+		pending: make(map[string]bool),
+	}
+}
+
+// hashedName inserts hash before the extension: css/site.css becomes
+// css/site.1a2b3c4d.css.
+func hashedName(p, hash string) string {
+	ext := path.Ext(p)
+	return strings.TrimSuffix(p, ext) + "." + hash + ext
+}
+
+// name returns the hashed path for rel, a slash-separated path relative to
+// the site dir, or false if rel is not a readable file.
+func (m *assetManifest) name(rel string) (string, bool) {
+	if name, ok := m.names[rel]; ok {
+		return name, true
+	}
+	if rel == "" || rel == "." || strings.HasPrefix(rel, "../") || m.pending[rel] {
+		return "", false
+	}
+	file := filepath.Join(m.dir, filepath.FromSlash(rel))
+	info, err := os.Stat(file)
+	if err != nil || info.IsDir() {
+		return "", false
+	}
+
+	var hash string
+	if strings.EqualFold(path.Ext(rel), ".css") {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", false
+		}
+		m.pending[rel] = true
+		rewritten := []byte(m.rewriteCSS("/"+rel, string(data)))
+		delete(m.pending, rel)
+		m.content[rel] = rewritten
+		hash = fmt.Sprintf("%x", sha256.Sum256(rewritten))[:8]
+	} else if hash, err = hashFile(file); err != nil {
+		return "", false
+	}
+	m.names[rel] = hashedName(rel, hash)
+	return m.names[rel], true
+}
+
+// ref rewrites a reference made from base (a page route or a stylesheet
+// path) to point at the hashed file. Only the file name changes, so
+// relative references stay relative. Anything that isn't a local file is
+// returned unchanged.
+func (m *assetManifest) ref(base, ref string) string {
+	if m == nil || !isLocalRef(ref) {
+		return ref
+	}
+	p, _, ok := resolveRoute(base, ref)
+	if !ok {
+		return ref
+	}
+	name, ok := m.name(strings.TrimPrefix(path.Clean(p), "/"))
+	if !ok {
+		return ref
+	}
+	end := len(ref)
+	if i := strings.IndexAny(ref, "?#"); i >= 0 {
+		end = i
+	}
+	slash := strings.LastIndex(ref[:end], "/") + 1
+	return ref[:slash] + path.Base(name) + ref[end:]
+}
+
+// rewriteCSS rewrites the url() and @import references in css.
+func (m *assetManifest) rewriteCSS(base, css string) string {
+	var sb strings.Builder
+	last := 0
+	for _, loc := range cssRefRe.FindAllStringSubmatchIndex(css, -1) {
+		start, end := loc[2], loc[3]
+		if start < 0 {
+			start, end = loc[4], loc[5]
+		}
+		sb.WriteString(css[last:start])
+		sb.WriteString(m.ref(base, css[start:end]))
+		last = end
+	}
+	sb.WriteString(css[last:])
+	return sb.String()
+}
+
+// rewriteSrcset rewrites the URL of every candidate in a srcset.
+func (m *assetManifest) rewriteSrcset(base, srcset string) string {
+	candidates := strings.Split(srcset, ",")
+	for i, candidate := range candidates {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			continue
+		}
+		fields[0] = m.ref(base, fields[0])
+		candidates[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// write copies every hashed asset into outDir under its hashed name,
+// skipping files that are already up to date. It returns the paths it wrote.
+func (m *assetManifest) write(outDir string) ([]string, error) {
+	rels := make([]string, 0, len(m.names))
+	for rel := range m.names {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+
+	var written []string
+	for _, rel := range rels {
+		dest := filepath.Join(outDir, filepath.FromSlash(m.names[rel]))
+		if data, ok := m.content[rel]; ok {
+			if existing, err := os.ReadFile(dest); err == nil && bytes.Equal(existing, data) {
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return written, err
+			}
+			if err := os.WriteFile(dest, data, 0644); err != nil {
+				return written, err
+			}
+			written = append(written, dest)
+			continue
+		}
+		copied, err := copyFileIfChanged(filepath.Join(m.dir, filepath.FromSlash(rel)), dest)
+		if err != nil {
+			return written, err
+		}
+		if copied {
+			written = append(written, dest)
+		}
+	}
+	return written, nil
+}
+
+// loadsRef reports whether n's attribute key names a file the page loads,
+// like an image, a script or a stylesheet, rather than a page or download it
+// links to. Only loaded files get hashed names: links are public URLs that
+// shouldn't change with every edit.
+func loadsRef(n *html.Node, key string) bool {
+	switch key {
+	case "src":
+		return n.Data != "iframe" && n.Data != "frame"
+	case "poster", "srcset":
+		return true
+	case "href":
+		if n.Data != "link" {
+			return false
+		}
+		for _, rel := range strings.Fields(strings.ToLower(getAttr(n, "rel"))) {
+			switch rel {
+			case "stylesheet", "icon", "apple-touch-icon", "mask-icon", "manifest", "preload", "modulepreload", "prefetch":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hashRefs points the files an element loads at their hashed names.
+func (s *processState) hashRefs(n *html.Node) {
+	if s.manifest == nil {
+		return
+	}
+	for i, a := range n.Attr {
+		switch {
+		case a.Key == "style":
+			n.Attr[i].Val = s.manifest.rewriteCSS(s.route, a.Val)
+		case !loadsRef(n, a.Key):
+		case a.Key == "srcset":
+			n.Attr[i].Val = s.manifest.rewriteSrcset(s.route, a.Val)
+		default:
+			n.Attr[i].Val = s.manifest.ref(s.route, a.Val)
+		}
+	}
+	if n.Data == "style" {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.TextNode {
+				c.Data = s.manifest.rewriteCSS(s.route, c.Data)
+			}
+		}
+	}
+}
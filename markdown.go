@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// MarkdownConfig turns on the Markdown extensions beyond GFM used by
+// <convert>. They're off by default since each changes how some existing
+// Markdown renders.
+type MarkdownConfig struct {
+	Footnotes         bool `yaml:"footnotes"`
+	DefinitionLists   bool `yaml:"definition_lists"`
+	HeadingAttributes bool `yaml:"heading_attributes"` // {#id .class} after a heading
+	Alerts            bool `yaml:"alerts"`             // > [!NOTE] blockquotes as <aside>
+	Figures           bool `yaml:"figures"`            // titled images on their own as <figure>
+	Math              bool `yaml:"math"`               // $...$ and $$...$$ as <math-tex>
+}
+
+// newMarkdown returns the goldmark instance for converting a page's
+// Markdown files.
+func newMarkdown(cfg MarkdownConfig) goldmark.Markdown {
+	extensions := []goldmark.Extender{
+		extension.GFM,
+		extension.Typographer,
+		highlighting.NewHighlighting(
+			highlighting.WithFormatOptions(
+				chromahtml.WithClasses(true),
+				chromahtml.PreventSurroundingPre(false),
+			),
+		),
+	}
+	if cfg.Footnotes {
+		extensions = append(extensions, extension.Footnote)
+	}
+	if cfg.DefinitionLists {
+		extensions = append(extensions, extension.DefinitionList)
+	}
+	parserOptions := []parser.Option{
+		parser.WithASTTransformers(
+			util.Prioritized(markdownPositions{}, 1000),
+			util.Prioritized(diagramTransformer{}, 500),
+		),
+	}
+	if cfg.HeadingAttributes {
+		parserOptions = append(parserOptions, parser.WithHeadingAttribute())
+	}
+	nodeRenderers := []util.PrioritizedValue{util.Prioritized(diagramRenderer{}, 500)}
+	if cfg.Alerts {
+		parserOptions = append(parserOptions, parser.WithASTTransformers(util.Prioritized(alertTransformer{}, 500)))
+		nodeRenderers = append(nodeRenderers, util.Prioritized(alertRenderer{}, 500))
+	}
+	if cfg.Figures {
+		parserOptions = append(parserOptions, parser.WithASTTransformers(util.Prioritized(figureTransformer{}, 500)))
+		nodeRenderers = append(nodeRenderers, util.Prioritized(figureRenderer{}, 500))
+	}
+	if cfg.Math {
+		parserOptions = append(parserOptions,
+			parser.WithBlockParsers(util.Prioritized(mathBlockParser{}, 150)),
+			parser.WithInlineParsers(util.Prioritized(mathInlineParser{}, 150)),
+		)
+		nodeRenderers = append(nodeRenderers, util.Prioritized(mathRenderer{}, 500))
+	}
+	return goldmark.New(
+		goldmark.WithExtensions(extensions...),
+		goldmark.WithParserOptions(parserOptions...),
+		goldmark.WithRendererOptions(gmhtml.WithUnsafe(), renderer.WithNodeRenderers(nodeRenderers...)),
+	)
+}
+
+// alertKinds are the GitHub alert types, as written in their [!MARKER].
+var alertKinds = []string{"NOTE", "TIP", "IMPORTANT", "WARNING", "CAUTION"}
+
+var kindAlert = ast.NewNodeKind("Alert")
+
+// alertNode is a GitHub-style > [!NOTE] blockquote.
+type alertNode struct {
+	ast.BaseBlock
+	kind string // lower case, such as "note"
+}
+
+func (n *alertNode) Kind() ast.NodeKind { return kindAlert }
+
+func (n *alertNode) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Kind": n.kind}, nil)
+}
+
+// alertTransformer turns blockquotes whose first line is an alert marker
+// into alertNodes, dropping the marker.
+type alertTransformer struct{}
+
+func (alertTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var quotes []*ast.Blockquote
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if q, ok := n.(*ast.Blockquote); ok && entering {
+			quotes = append(quotes, q)
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, q := range quotes {
+		p, ok := q.FirstChild().(*ast.Paragraph)
+		if !ok || p.Lines().Len() == 0 {
+			continue
+		}
+		first := p.Lines().At(0)
+		marker := strings.TrimSpace(string(first.Value(source)))
+		if len(marker) < 4 || !strings.HasPrefix(marker, "[!") || !strings.HasSuffix(marker, "]") {
+			continue
+		}
+		kind := strings.ToUpper(marker[2 : len(marker)-1])
+		if !slices.Contains(alertKinds, kind) {
+			continue
+		}
+
+		// Drop the inlines on the marker's line, and the paragraph too if
+		// that was all it held.
+		for c := p.FirstChild(); c != nil; {
+			next := c.NextSibling()
+			t, ok := c.(*ast.Text)
+			if !ok || t.Segment.Start >= first.Stop {
+				break
+			}
+			p.RemoveChild(p, c)
+			c = next
+		}
+		if p.ChildCount() == 0 {
+			q.RemoveChild(q, p)
+		}
+
+		alert := &alertNode{kind: strings.ToLower(kind)}
+		for _, attr := range q.Attributes() {
+			alert.SetAttribute(attr.Name, attr.Value)
+		}
+		for c := q.FirstChild(); c != nil; c = q.FirstChild() {
+			alert.AppendChild(alert, c)
+		}
+		q.Parent().ReplaceChild(q.Parent(), q, alert)
+	}
+}
+
+// alertCSS is the default look of alerts. Its selectors sit in :where(), so
+// they weigh nothing against the site's own stylesheets.
+const alertCSS = `:where(.alert) { --alert-color: #0969da; margin: 1rem 0; padding: 0.5rem 1rem; border-left: 0.25rem solid var(--alert-color); }
+:where(.alert-tip) { --alert-color: #1a7f37; }
+:where(.alert-important) { --alert-color: #8250df; }
+:where(.alert-warning) { --alert-color: #9a6700; }
+:where(.alert-caution) { --alert-color: #d1242f; }
+:where(.alert-title) { margin-top: 0; font-weight: 600; color: var(--alert-color); }
+:where(.alert > :last-child) { margin-bottom: 0; }
+`
+
+// alertRenderer writes alerts as <aside class="alert alert-note">, with the
+// alert's name as a title for styling.
+type alertRenderer struct{}
+
+func (alertRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindAlert, func(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+		n := node.(*alertNode)
+		if !entering {
+			_, _ = w.WriteString("</aside>\n")
+			return ast.WalkContinue, nil
+		}
+		_, _ = w.WriteString(`<aside class="alert alert-` + n.kind + `" role="note"`)
+		gmhtml.RenderAttributes(w, n, nil)
+		_, _ = w.WriteString(">\n<p class=\"alert-title\">" + strings.ToUpper(n.kind[:1]) + n.kind[1:] + "</p>\n")
+		return ast.WalkContinue, nil
+	})
+}
+
+var kindFigure = ast.NewNodeKind("Figure")
+
+// figureNode is an image with a title, alone in its paragraph.
+type figureNode struct {
+	ast.BaseBlock
+	caption []byte
+}
+
+func (n *figureNode) Kind() ast.NodeKind { return kindFigure }
+
+func (n *figureNode) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Caption": string(n.caption)}, nil)
+}
+
+// figureTransformer turns paragraphs holding nothing but a titled image
+// into figures captioned with the title.
+type figureTransformer struct{}
+
+func (figureTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	var paragraphs []*ast.Paragraph
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if p, ok := n.(*ast.Paragraph); ok && entering {
+			paragraphs = append(paragraphs, p)
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, p := range paragraphs {
+		img, ok := p.FirstChild().(*ast.Image)
+		if !ok || p.ChildCount() != 1 || len(bytes.TrimSpace(img.Title)) == 0 {
+			continue
+		}
+		fig := &figureNode{caption: img.Title}
+		img.Title = nil
+		for _, attr := range p.Attributes() {
+			fig.SetAttribute(attr.Name, attr.Value)
+		}
+		fig.AppendChild(fig, img)
+		p.Parent().ReplaceChild(p.Parent(), p, fig)
+	}
+}
+
+type figureRenderer struct{}
+
+func (figureRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindFigure, func(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+		n := node.(*figureNode)
+		if entering {
+			_, _ = w.WriteString("<figure")
+			gmhtml.RenderAttributes(w, n, nil)
+			_, _ = w.WriteString(">\n")
+			return ast.WalkContinue, nil
+		}
+		_, _ = w.WriteString("\n<figcaption>")
+		_, _ = w.Write(util.EscapeHTML(n.caption))
+		_, _ = w.WriteString("</figcaption>\n</figure>\n")
+		return ast.WalkContinue, nil
+	})
+}
+
+var kindDiagram = ast.NewNodeKind("Diagram")
+
+// diagramNode is a ```diagram fence of ASCII art.
+type diagramNode struct {
+	ast.BaseBlock
+}
+
+func (n *diagramNode) Kind() ast.NodeKind { return kindDiagram }
+
+func (n *diagramNode) IsRaw() bool { return true }
+
+func (n *diagramNode) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+// diagramTransformer turns ```diagram fences into diagramNodes, before
+// the highlighter sees them as code.
+type diagramTransformer struct{}
+
+func (diagramTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var fences []*ast.FencedCodeBlock
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if f, ok := n.(*ast.FencedCodeBlock); ok && entering && string(f.Language(source)) == "diagram" {
+			fences = append(fences, f)
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, f := range fences {
+		d := &diagramNode{}
+		d.SetLines(f.Lines())
+		for _, attr := range f.Attributes() {
+			d.SetAttribute(attr.Name, attr.Value)
+		}
+		f.Parent().ReplaceChild(f.Parent(), f, d)
+	}
+}
+
+// diagramRenderer writes diagrams as <diagram> elements, which
+// processContent draws as SVG like the ones in pager.html.
+type diagramRenderer struct{}
+
+func (diagramRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindDiagram, func(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		_, _ = w.WriteString("<diagram")
+		gmhtml.RenderAttributes(w, node, nil)
+		_, _ = w.WriteString(">")
+		lines := node.Lines()
+		for i := 0; i < lines.Len(); i++ {
+			line := lines.At(i)
+			_, _ = w.Write(util.EscapeHTML(line.Value(source)))
+		}
+		_, _ = w.WriteString("</diagram>\n")
+		return ast.WalkContinue, nil
+	})
+}
+
+var (
+	kindMathInline = ast.NewNodeKind("MathInline")
+	kindMathBlock  = ast.NewNodeKind("MathBlock")
+)
+
+// mathInline is $...$ math in a paragraph, with its TeX as a text child.
+// $$...$$ in the middle of a paragraph is display math too.
+type mathInline struct {
+	ast.BaseInline
+	display bool
+}
+
+func (n *mathInline) Kind() ast.NodeKind { return kindMathInline }
+
+func (n *mathInline) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+// mathInlineParser reads $...$ the way Pandoc does: the opening $ can't be
+// followed by a space, the closing $ can't follow a space or be followed
+// by a digit, so prices like $5 and $10 stay text.
+type mathInlineParser struct{}
+
+func (mathInlineParser) Trigger() []byte { return []byte{'$'} }
+
+func (mathInlineParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, segment := block.PeekLine()
+	delim := 1
+	if len(line) > 1 && line[1] == '$' {
+		delim = 2
+	}
+	start := delim
+	if start >= len(line) || util.IsSpace(line[start]) {
+		return nil
+	}
+	for i := start; i+delim <= len(line); i++ {
+		switch {
+		case line[i] == '\\':
+			i++
+		case line[i] == '$' && (delim == 1 || i+1 < len(line) && line[i+1] == '$'):
+			if util.IsSpace(line[i-1]) || i == start {
+				return nil
+			}
+			if delim == 1 && i+1 < len(line) && line[i+1] >= '0' && line[i+1] <= '9' {
+				return nil
+			}
+			n := &mathInline{display: delim == 2}
+			n.AppendChild(n, ast.NewTextSegment(text.NewSegment(segment.Start+start, segment.Start+i)))
+			block.Advance(i + delim)
+			return n
+		}
+	}
+	return nil
+}
+
+// mathBlock is display math between $$ lines.
+type mathBlock struct {
+	ast.BaseBlock
+	closed bool // the closing $$ has been read
+}
+
+func (n *mathBlock) Kind() ast.NodeKind { return kindMathBlock }
+
+func (n *mathBlock) IsRaw() bool { return true }
+
+func (n *mathBlock) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+// mathBlockParser reads display math from a line starting with $$ to the
+// next line ending with $$, which may be the same line.
+type mathBlockParser struct{}
+
+func (mathBlockParser) Trigger() []byte { return []byte{'$'} }
+
+func (mathBlockParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	line, segment := reader.PeekLine()
+	pos := pc.BlockOffset()
+	if pos < 0 || !bytes.HasPrefix(line[pos:], []byte("$$")) {
+		return nil, parser.NoChildren
+	}
+	n := &mathBlock{}
+	start := segment.Start - segment.Padding + pos + 2
+	rest := util.TrimRightSpace(line[pos+2:])
+	if len(rest) >= 2 && bytes.HasSuffix(rest, []byte("$$")) {
+		n.Lines().Append(text.NewSegment(start, start+len(rest)-2))
+		n.closed = true
+	} else if !util.IsBlank(rest) {
+		n.Lines().Append(text.NewSegment(start, start+len(rest)))
+	}
+	return n, parser.NoChildren
+}
+
+func (mathBlockParser) Continue(node ast.Node, reader text.Reader, pc parser.Context) parser.State {
+	n := node.(*mathBlock)
+	if n.closed {
+		return parser.Close
+	}
+	line, segment := reader.PeekLine()
+	trimmed := util.TrimRightSpace(line)
+	if bytes.HasSuffix(trimmed, []byte("$$")) {
+		if len(trimmed) > 2 {
+			n.Lines().Append(text.NewSegment(segment.Start, segment.Start+len(trimmed)-2))
+		}
+		newline := 0
+		if line[len(line)-1] == '\n' {
+			newline = 1
+		}
+		reader.Advance(segment.Len() - newline)
+		return parser.Close
+	}
+	n.Lines().Append(segment)
+	reader.Advance(segment.Len() - 1)
+	return parser.Continue | parser.NoChildren
+}
+
+func (mathBlockParser) Close(node ast.Node, reader text.Reader, pc parser.Context) {}
+
+func (mathBlockParser) CanInterruptParagraph() bool { return true }
+
+func (mathBlockParser) CanAcceptIndentedLine() bool { return false }
+
+// mathRenderer writes math as <math-tex> elements, which processContent
+// renders to MathML like the ones written in pager.html.
+type mathRenderer struct{}
+
+func (mathRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindMathInline, func(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		n := node.(*mathInline)
+		var tex bytes.Buffer
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			tex.Write(c.(*ast.Text).Segment.Value(source))
+		}
+		writeMathTex(w, n, tex.Bytes(), n.display)
+		return ast.WalkSkipChildren, nil
+	})
+	reg.Register(kindMathBlock, func(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		var tex bytes.Buffer
+		lines := node.Lines()
+		for i := 0; i < lines.Len(); i++ {
+			line := lines.At(i)
+			tex.Write(line.Value(source))
+		}
+		writeMathTex(w, node, tex.Bytes(), true)
+		_ = w.WriteByte('\n')
+		return ast.WalkContinue, nil
+	})
+}
+
+// writeMathTex writes one <math-tex> element, with n's attributes.
+func writeMathTex(w util.BufWriter, n ast.Node, tex []byte, display bool) {
+	_, _ = w.WriteString("<math-tex")
+	if display {
+		_, _ = w.WriteString(` display="block"`)
+	}
+	gmhtml.RenderAttributes(w, n, nil)
+	_, _ = w.WriteString(">")
+	_, _ = w.Write(util.EscapeHTML(tex))
+	_, _ = w.WriteString("</math-tex>")
+}
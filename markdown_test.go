@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMarkdownExtensions(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		cfg      MarkdownConfig
+		in       string
+		want     []string
+		dontWant []string
+	}{
+		{
+			name: "alerts",
+			cfg:  MarkdownConfig{Alerts: true},
+			in:   "> [!WARNING]\n> Mind the gap.\n",
+			want: []string{`<aside class="alert alert-warning" role="note"`, `<p class="alert-title">Warning</p>`, "Mind the gap."},
+		},
+		{
+			name:     "alerts off",
+			in:       "> [!WARNING]\n> Mind the gap.\n",
+			want:     []string{"<blockquote", "[!WARNING]"},
+			dontWant: []string{"<aside"},
+		},
+		{
+			name:     "unknown alert kind",
+			cfg:      MarkdownConfig{Alerts: true},
+			in:       "> [!DANGER]\n> x\n",
+			want:     []string{"<blockquote"},
+			dontWant: []string{"<aside"},
+		},
+		{
+			name: "figures",
+			cfg:  MarkdownConfig{Figures: true},
+			in:   "![A cat](cat.png \"Our cat\")\n",
+			want: []string{"<figure", `<img src="cat.png" alt="A cat"`, "<figcaption>Our cat</figcaption>"},
+		},
+		{
+			name:     "untitled image",
+			cfg:      MarkdownConfig{Figures: true},
+			in:       "![A cat](cat.png)\n",
+			dontWant: []string{"<figure"},
+		},
+		{
+			name: "footnotes",
+			cfg:  MarkdownConfig{Footnotes: true},
+			in:   "Text[^1].\n\n[^1]: The note.\n",
+			want: []string{`class="footnote-ref"`, "The note."},
+		},
+		{
+			name: "definition lists",
+			cfg:  MarkdownConfig{DefinitionLists: true},
+			in:   "Term\n: Definition\n",
+			want: []string{"<dl>", "<dt>Term</dt>", "<dd>Definition</dd>"},
+		},
+		{
+			name: "heading attributes",
+			cfg:  MarkdownConfig{HeadingAttributes: true},
+			in:   "# Title {#top .big}\n",
+			want: []string{`id="top"`, `class="big"`},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := newMarkdown(tt.cfg).Convert([]byte(tt.in), &buf); err != nil {
+				t.Fatal(err)
+			}
+			got := buf.String()
+			for _, w := range tt.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("got %s, want it to contain %s", got, w)
+				}
+			}
+			for _, w := range tt.dontWant {
+				if strings.Contains(got, w) {
+					t.Errorf("got %s, want it without %s", got, w)
+				}
+			}
+		})
+	}
+}
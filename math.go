@@ -0,0 +1,915 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+// texToMathML renders a TeX math expression as a MathML <math> element,
+// keeping the TeX as an annotation. It covers the subset of TeX used in
+// everyday technical writing; anything else is rendered as an <merror> and
+// returned as a problem.
+func texToMathML(tex string, display bool) (string, []string) {
+	tex = strings.TrimSpace(tex)
+	p := &texParser{src: []rune(tex), display: display}
+	nodes := p.parseAll()
+
+	var b strings.Builder
+	b.WriteString("<math")
+	if display {
+		b.WriteString(` display="block"`)
+	}
+	b.WriteString("><semantics>")
+	b.WriteString(mrow(nodes))
+	b.WriteString(`<annotation encoding="application/x-tex">`)
+	b.WriteString(html.EscapeString(tex))
+	b.WriteString("</annotation></semantics></math>")
+	return b.String(), p.errs
+}
+
+// mathTeX returns the TeX annotation of a <math> element rendered by
+// texToMathML.
+func mathTeX(n *html.Node) (string, bool) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		if c.Data == "annotation" && getAttr(c, "encoding") == "application/x-tex" {
+			return textContent(c), true
+		}
+		if tex, ok := mathTeX(c); ok {
+			return tex, true
+		}
+	}
+	return "", false
+}
+
+// texParser is a recursive descent parser from TeX to MathML markup.
+type texParser struct {
+	src     []rune
+	pos     int
+	display bool
+	font    string // the \mathbf-style font of the letters and digits being read
+	errs    []string
+}
+
+// mathNode is one rendered atom.
+type mathNode struct {
+	xml string
+	// limits puts the atom's scripts above and below it in display math,
+	// as for \sum; under does so everywhere, as for \underbrace.
+	limits bool
+	under  bool
+	// fn marks function names such as \sin, which are followed by an
+	// invisible function application after their scripts.
+	fn bool
+}
+
+func (p *texParser) errorf(format string, args ...any) {
+	p.errs = append(p.errs, fmt.Sprintf(format, args...))
+}
+
+func (p *texParser) eof() bool { return p.pos >= len(p.src) }
+
+func (p *texParser) peek() rune {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+// skipSpace skips white space and % comments, which TeX ignores in math.
+func (p *texParser) skipSpace() {
+	for !p.eof() {
+		switch c := p.src[p.pos]; {
+		case unicode.IsSpace(c):
+			p.pos++
+		case c == '%':
+			for !p.eof() && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// peekCommand returns the name of the command at the current position
+// without reading it, or "" if there isn't one. Commands are a backslash
+// and either a run of letters or one other character.
+func (p *texParser) peekCommand() string {
+	if p.peek() != '\\' || p.pos+1 >= len(p.src) {
+		return ""
+	}
+	end := p.pos + 1
+	for end < len(p.src) && isASCIILetter(p.src[end]) {
+		end++
+	}
+	if end == p.pos+1 {
+		end++
+	}
+	return string(p.src[p.pos+1 : end])
+}
+
+func (p *texParser) readCommand() string {
+	name := p.peekCommand()
+	p.pos += 1 + len([]rune(name))
+	if name != "" && isASCIILetter([]rune(name)[0]) {
+		// A space after a command word only ends it.
+		for !p.eof() && p.src[p.pos] == ' ' {
+			p.pos++
+		}
+	}
+	return name
+}
+
+// atStop reports whether the parser is at something that ends a list of
+// atoms: a closing brace, a column or row break, or the end of a \left
+// or an environment.
+func (p *texParser) atStop() bool {
+	if c := p.peek(); c == '}' || c == '&' {
+		return true
+	}
+	switch p.peekCommand() {
+	case `\`, "cr", "right", "middle", "end":
+		return true
+	}
+	return false
+}
+
+// skipStop reports and skips a stop that nothing around it can close.
+func (p *texParser) skipStop() {
+	if c := p.peek(); c == '}' || c == '&' {
+		p.errorf("unexpected %c", c)
+		p.pos++
+		return
+	}
+	name := p.readCommand()
+	p.errorf(`unexpected \%s`, name)
+	switch name {
+	case "right", "middle":
+		p.readDelimiter()
+	case "end":
+		p.readRawArg()
+	}
+}
+
+// parseAll parses the whole expression.
+func (p *texParser) parseAll() []mathNode {
+	var nodes []mathNode
+	for {
+		nodes = append(nodes, p.parseList()...)
+		if p.eof() {
+			return nodes
+		}
+		p.skipStop()
+	}
+}
+
+// parseList parses atoms up to the next stop.
+func (p *texParser) parseList() []mathNode {
+	var nodes []mathNode
+	for {
+		p.skipSpace()
+		if p.eof() || p.atStop() {
+			return nodes
+		}
+		nodes = append(nodes, p.parseAtom())
+	}
+}
+
+// parseGroup parses a {...} group, after its opening brace.
+func (p *texParser) parseGroup() []mathNode {
+	var nodes []mathNode
+	for {
+		nodes = append(nodes, p.parseList()...)
+		if p.eof() {
+			p.errorf("missing }")
+			return nodes
+		}
+		if p.peek() == '}' {
+			p.pos++
+			return nodes
+		}
+		p.skipStop()
+	}
+}
+
+// parseAtom parses one atom and its subscript, superscript and primes.
+func (p *texParser) parseAtom() mathNode {
+	base := p.parseBase(false)
+	var sub, sup string
+	var hasSub, hasSup bool
+	primes := ""
+	limits := base.under || (base.limits && p.display)
+	for {
+		p.skipSpace()
+		switch c := p.peek(); {
+		case c == '\'':
+			p.pos++
+			primes += "<mo>′</mo>"
+		case c == '^' || c == '_':
+			p.pos++
+			if c == '^' && hasSup {
+				p.errorf("double superscript")
+			} else if c == '_' && hasSub {
+				p.errorf("double subscript")
+			}
+			arg := p.parseArg()
+			if c == '^' {
+				sup, hasSup = arg, true
+			} else {
+				sub, hasSub = arg, true
+			}
+		case p.peekCommand() == "limits":
+			p.readCommand()
+			limits = true
+		case p.peekCommand() == "nolimits":
+			p.readCommand()
+			limits = false
+		default:
+			goto done
+		}
+	}
+done:
+	if primes != "" {
+		if hasSup {
+			sup = "<mrow>" + primes + sup + "</mrow>"
+		} else {
+			sup = primes
+			if strings.Count(primes, "<mo>") > 1 {
+				sup = "<mrow>" + primes + "</mrow>"
+			}
+		}
+		hasSup = true
+	}
+
+	xml := base.xml
+	switch {
+	case hasSub && hasSup && limits:
+		xml = "<munderover>" + xml + sub + sup + "</munderover>"
+	case hasSub && hasSup:
+		xml = "<msubsup>" + xml + sub + sup + "</msubsup>"
+	case hasSub && limits:
+		xml = "<munder>" + xml + sub + "</munder>"
+	case hasSub:
+		xml = "<msub>" + xml + sub + "</msub>"
+	case hasSup && limits:
+		xml = "<mover>" + xml + sup + "</mover>"
+	case hasSup:
+		xml = "<msup>" + xml + sup + "</msup>"
+	}
+	if base.fn {
+		xml += "<mo>&#x2061;</mo>"
+		// TeX sets a thin space between a function and its argument,
+		// unless the argument is in brackets.
+		if p.skipSpace(); !p.eof() && p.peek() != '(' && p.peek() != '[' && !p.atStop() && p.peekCommand() != "left" {
+			xml += `<mspace width="0.1667em"/>`
+		}
+	}
+	return mathNode{xml: xml}
+}
+
+// parseArg parses a command or script argument: a group or a single token.
+func (p *texParser) parseArg() string {
+	p.skipSpace()
+	if p.eof() || p.atStop() {
+		p.errorf("missing argument")
+		return "<mrow></mrow>"
+	}
+	return p.parseBase(true).xml
+}
+
+// readRawArg reads a {...} argument as text, for environment names and
+// \text.
+func (p *texParser) readRawArg() string {
+	p.skipSpace()
+	if p.peek() != '{' {
+		if p.eof() {
+			p.errorf("missing argument")
+			return ""
+		}
+		c := p.src[p.pos]
+		p.pos++
+		return string(c)
+	}
+	p.pos++
+	start, depth := p.pos, 0
+	for ; !p.eof(); p.pos++ {
+		switch p.src[p.pos] {
+		case '\\':
+			p.pos++
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				s := string(p.src[start:p.pos])
+				p.pos++
+				return s
+			}
+			depth--
+		}
+	}
+	p.errorf("missing }")
+	return string(p.src[start:])
+}
+
+// parseBase parses an atom without its scripts. As an argument, a number
+// is only its first digit, as in x^23.
+func (p *texParser) parseBase(arg bool) mathNode {
+	c := p.peek()
+	switch {
+	case c == '{':
+		p.pos++
+		return mathNode{xml: mrow(p.parseGroup())}
+	case c == '\\':
+		return p.parseCommand()
+	case c >= '0' && c <= '9' || c == '.' && p.pos+1 < len(p.src) && p.src[p.pos+1] >= '0' && p.src[p.pos+1] <= '9':
+		start := p.pos
+		p.pos++
+		for !arg && !p.eof() && (isDigit(p.src[p.pos]) || p.src[p.pos] == '.' && p.pos+1 < len(p.src) && isDigit(p.src[p.pos+1])) {
+			p.pos++
+		}
+		var digits strings.Builder
+		for _, d := range p.src[start:p.pos] {
+			digits.WriteString(mathFont(d, p.font))
+		}
+		return mathNode{xml: "<mn>" + digits.String() + "</mn>"}
+	case unicode.IsLetter(c):
+		p.pos++
+		return mathNode{xml: p.identifier(c)}
+	case c == '^' || c == '_':
+		// A script with nothing before it, as in {}^{14}C.
+		return mathNode{xml: "<mrow></mrow>"}
+	case c == '~':
+		p.pos++
+		return mathNode{xml: "<mtext>&#xA0;</mtext>"}
+	case c == '#' || c == '$':
+		p.pos++
+		p.errorf("unexpected %c", c)
+		return mathNode{xml: "<merror><mtext>" + string(c) + "</mtext></merror>"}
+	}
+	p.pos++
+	switch c {
+	case '-':
+		return mathNode{xml: "<mo>−</mo>"}
+	case '*':
+		return mathNode{xml: "<mo>∗</mo>"}
+	case '\'':
+		return mathNode{xml: "<mo>′</mo>"}
+	}
+	return mathNode{xml: operator(string(c))}
+}
+
+// identifier renders a letter in the current font.
+func (p *texParser) identifier(c rune) string {
+	if p.font == "rm" {
+		return `<mi mathvariant="normal">` + html.EscapeString(string(c)) + "</mi>"
+	}
+	return "<mi>" + html.EscapeString(mathFont(c, p.font)) + "</mi>"
+}
+
+func (p *texParser) parseCommand() mathNode {
+	name := p.readCommand()
+	if name == "" {
+		p.pos++
+		p.errorf(`unexpected \ at the end`)
+		return mathNode{xml: "<mrow></mrow>"}
+	}
+	if width, ok := mathSpaces[name]; ok {
+		return mathNode{xml: `<mspace width="` + width + `"/>`}
+	}
+	if s, ok := mathIdentifiers[name]; ok {
+		return mathNode{xml: "<mi>" + s + "</mi>"}
+	}
+	if s, ok := mathUprightIdentifiers[name]; ok {
+		return mathNode{xml: `<mi mathvariant="normal">` + s + "</mi>"}
+	}
+	if s, ok := mathOperators[name]; ok {
+		return mathNode{xml: operator(s)}
+	}
+	if s, ok := mathBigOperators[name]; ok {
+		return mathNode{xml: "<mo>" + s + "</mo>", limits: true}
+	}
+	if s, ok := mathIntegrals[name]; ok {
+		return mathNode{xml: "<mo>" + s + "</mo>"}
+	}
+	if s, ok := mathFunctions[name]; ok {
+		return mathNode{xml: "<mi>" + s + "</mi>", fn: true}
+	}
+	if s, ok := mathLimitFunctions[name]; ok {
+		return mathNode{xml: "<mi>" + s + "</mi>", fn: true, limits: true}
+	}
+	if font, ok := mathFonts[name]; ok {
+		outer := p.font
+		p.font = font
+		arg := p.parseArg()
+		p.font = outer
+		return mathNode{xml: arg}
+	}
+	if accent, ok := mathAccents[name]; ok {
+		stretchy := "false"
+		if strings.HasPrefix(name, "wide") || strings.HasPrefix(name, "over") {
+			stretchy = "true"
+		}
+		return mathNode{xml: `<mover accent="true">` + p.parseArg() + `<mo stretchy="` + stretchy + `">` + accent + "</mo></mover>"}
+	}
+	if variant, ok := mathTextCommands[name]; ok {
+		attr := ""
+		if variant != "" {
+			attr = ` mathvariant="` + variant + `"`
+		}
+		return mathNode{xml: "<mtext" + attr + ">" + html.EscapeString(strings.ReplaceAll(p.readRawArg(), "~", " ")) + "</mtext>"}
+	}
+	if size, ok := mathBigDelimiters[strings.TrimRight(name, "lrm")]; ok {
+		d := p.readDelimiter()
+		if d == "" {
+			return mathNode{xml: "<mrow></mrow>"}
+		}
+		return mathNode{xml: `<mo minsize="` + size + `" maxsize="` + size + `">` + d + "</mo>"}
+	}
+
+	switch name {
+	case "frac", "dfrac", "tfrac", "cfrac":
+		num := p.parseArg()
+		den := p.parseArg()
+		return mathNode{xml: mathStyle(name, "<mfrac>"+num+den+"</mfrac>")}
+	case "binom", "dbinom", "tbinom":
+		top := p.parseArg()
+		bottom := p.parseArg()
+		frac := `<mfrac linethickness="0">` + top + bottom + "</mfrac>"
+		return mathNode{xml: mathStyle(name, `<mrow><mo stretchy="true">(</mo>`+frac+`<mo stretchy="true">)</mo></mrow>`)}
+	case "sqrt":
+		p.skipSpace()
+		if p.peek() == '[' {
+			index := p.parseSub(p.readBracketArg())
+			return mathNode{xml: "<mroot>" + p.parseArg() + index + "</mroot>"}
+		}
+		return mathNode{xml: "<msqrt>" + p.parseArg() + "</msqrt>"}
+	case "operatorname":
+		star := p.peek() == '*'
+		if star {
+			p.pos++
+		}
+		text := html.EscapeString(p.readRawArg())
+		if len([]rune(text)) == 1 {
+			return mathNode{xml: `<mi mathvariant="normal">` + text + "</mi>", fn: true, limits: star}
+		}
+		return mathNode{xml: "<mi>" + text + "</mi>", fn: true, limits: star}
+	case "overline":
+		return mathNode{xml: `<mover accent="true">` + p.parseArg() + `<mo stretchy="true">‾</mo></mover>`}
+	case "underline":
+		return mathNode{xml: `<munder accentunder="true">` + p.parseArg() + `<mo stretchy="true">_</mo></munder>`}
+	case "overbrace":
+		return mathNode{xml: `<mover>` + p.parseArg() + `<mo stretchy="true">⏞</mo></mover>`, under: true}
+	case "underbrace":
+		return mathNode{xml: `<munder>` + p.parseArg() + `<mo stretchy="true">⏟</mo></munder>`, under: true}
+	case "overset", "stackrel":
+		over := p.parseArg()
+		return mathNode{xml: "<mover>" + p.parseArg() + over + "</mover>"}
+	case "underset":
+		under := p.parseArg()
+		return mathNode{xml: "<munder>" + p.parseArg() + under + "</munder>"}
+	case "not":
+		op := p.parseArg()
+		if !strings.HasPrefix(op, "<mo") {
+			p.errorf(`\not must be followed by a relation`)
+			return mathNode{xml: op}
+		}
+		return mathNode{xml: strings.Replace(op, "</mo>", "̸</mo>", 1)}
+	case "pmod":
+		return mathNode{xml: `<mrow><mspace width="1em"/><mo stretchy="false">(</mo><mi>mod</mi><mspace width="0.3333em"/>` + p.parseArg() + `<mo stretchy="false">)</mo></mrow>`}
+	case "bmod":
+		return mathNode{xml: `<mo lspace="0.2222em" rspace="0.2222em">mod</mo>`}
+	case "mod":
+		return mathNode{xml: `<mrow><mspace width="1em"/><mi>mod</mi><mspace width="0.3333em"/></mrow>`}
+	case "displaystyle", "textstyle":
+		return mathNode{xml: `<mstyle displaystyle="` + fmt.Sprint(name == "displaystyle") + `" scriptlevel="0">` + mrow(p.parseList()) + "</mstyle>"}
+	case "left":
+		return p.parseLeftRight()
+	case "begin":
+		return p.parseEnvironment(p.readRawArg())
+	}
+	p.errorf(`unsupported command \%s`, name)
+	return mathNode{xml: `<merror><mtext>\` + html.EscapeString(name) + "</mtext></merror>"}
+}
+
+// parseSub parses a fragment of the expression, such as the index of a
+// root, with a parser of its own.
+func (p *texParser) parseSub(tex string) string {
+	sub := &texParser{src: []rune(tex), font: p.font}
+	nodes := sub.parseAll()
+	p.errs = append(p.errs, sub.errs...)
+	return mrow(nodes)
+}
+
+// readBracketArg reads an optional [...] argument as text.
+func (p *texParser) readBracketArg() string {
+	p.pos++
+	start, depth := p.pos, 0
+	for ; !p.eof(); p.pos++ {
+		switch p.src[p.pos] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ']':
+			if depth == 0 {
+				s := string(p.src[start:p.pos])
+				p.pos++
+				return s
+			}
+		}
+	}
+	p.errorf("missing ]")
+	return string(p.src[start:])
+}
+
+// readDelimiter reads the delimiter after \left, \right, \middle or \big;
+// "." is no delimiter at all and returns "".
+func (p *texParser) readDelimiter() string {
+	p.skipSpace()
+	if p.eof() {
+		p.errorf("missing delimiter")
+		return ""
+	}
+	if name := p.peekCommand(); name != "" {
+		p.readCommand()
+		if d, ok := mathDelimiters[name]; ok {
+			return d
+		}
+		p.errorf(`\%s is not a delimiter`, name)
+		return ""
+	}
+	c := p.src[p.pos]
+	p.pos++
+	switch c {
+	case '.':
+		return ""
+	case '(', ')', '[', ']', '|', '/':
+		return string(c)
+	case '<':
+		return "⟨"
+	case '>':
+		return "⟩"
+	}
+	p.errorf("%c is not a delimiter", c)
+	return ""
+}
+
+// parseLeftRight parses the rest of a \left ... \right pair.
+func (p *texParser) parseLeftRight() mathNode {
+	var b strings.Builder
+	b.WriteString("<mrow>")
+	if d := p.readDelimiter(); d != "" {
+		b.WriteString(`<mo fence="true" form="prefix" stretchy="true">` + html.EscapeString(d) + "</mo>")
+	}
+	for {
+		b.WriteString(mrow(p.parseList()))
+		switch {
+		case p.eof():
+			p.errorf(`missing \right`)
+		case p.peekCommand() == "middle":
+			p.readCommand()
+			if d := p.readDelimiter(); d != "" {
+				b.WriteString(`<mo fence="true" stretchy="true">` + html.EscapeString(d) + "</mo>")
+			}
+			continue
+		case p.peekCommand() == "right":
+			p.readCommand()
+			if d := p.readDelimiter(); d != "" {
+				b.WriteString(`<mo fence="true" form="postfix" stretchy="true">` + html.EscapeString(d) + "</mo>")
+			}
+		default:
+			p.skipStop()
+			continue
+		}
+		break
+	}
+	b.WriteString("</mrow>")
+	return mathNode{xml: b.String()}
+}
+
+// mathEnvironment describes how an environment lays out its table.
+type mathEnvironment struct {
+	open, close string // delimiters around the table
+	align       string // column alignment, repeated across the columns
+	display     bool   // cells in display style, as in aligned
+}
+
+var mathEnvironments = map[string]mathEnvironment{
+	"matrix":   {},
+	"pmatrix":  {open: "(", close: ")"},
+	"bmatrix":  {open: "[", close: "]"},
+	"Bmatrix":  {open: "{", close: "}"},
+	"vmatrix":  {open: "|", close: "|"},
+	"Vmatrix":  {open: "‖", close: "‖"},
+	"cases":    {open: "{", align: "left"},
+	"aligned":  {align: "right left", display: true},
+	"align":    {align: "right left", display: true},
+	"align*":   {align: "right left", display: true},
+	"split":    {align: "right left", display: true},
+	"gathered": {display: true},
+	"gather":   {display: true},
+	"gather*":  {display: true},
+	"array":    {},
+}
+
+// parseEnvironment parses a \begin{name} ... \end{name} table.
+func (p *texParser) parseEnvironment(name string) mathNode {
+	env, ok := mathEnvironments[name]
+	if !ok {
+		p.errorf("unsupported environment %s", name)
+		env = mathEnvironment{}
+	}
+	align := env.align
+	if name == "array" {
+		var cols []string
+		for _, c := range p.readRawArg() {
+			switch c {
+			case 'l':
+				cols = append(cols, "left")
+			case 'c':
+				cols = append(cols, "center")
+			case 'r':
+				cols = append(cols, "right")
+			}
+		}
+		align = strings.Join(cols, " ")
+	}
+
+	var rows [][]string
+	var row []string
+	for {
+		row = append(row, mrow(p.parseList()))
+		if p.eof() {
+			p.errorf(`missing \end{%s}`, name)
+			break
+		}
+		if p.peek() == '&' {
+			p.pos++
+			continue
+		}
+		cmd := p.peekCommand()
+		if cmd == `\` || cmd == "cr" {
+			p.readCommand()
+			// Skip the spacing in \\[4pt].
+			if p.skipSpace(); p.peek() == '[' {
+				p.readBracketArg()
+			}
+			rows = append(rows, row)
+			row = nil
+			continue
+		}
+		if cmd == "end" {
+			p.readCommand()
+			if end := p.readRawArg(); end != name {
+				p.errorf(`\begin{%s} ended by \end{%s}`, name, end)
+			}
+			break
+		}
+		p.skipStop()
+	}
+	// A \\ before \end doesn't start another row.
+	if !(len(row) == 1 && row[0] == "<mrow></mrow>") || len(rows) == 0 {
+		rows = append(rows, row)
+	}
+
+	// MathML repeats the last alignment across the remaining columns, so
+	// alternating ones like aligned's are spelled out.
+	if words := strings.Fields(align); len(words) > 1 {
+		columns := 0
+		for _, row := range rows {
+			columns = max(columns, len(row))
+		}
+		var cols []string
+		for i := range columns {
+			cols = append(cols, words[i%len(words)])
+		}
+		align = strings.Join(cols, " ")
+	}
+
+	var b strings.Builder
+	b.WriteString("<mtable")
+	if align != "" {
+		b.WriteString(` columnalign="` + align + `"`)
+	}
+	if env.display {
+		b.WriteString(` displaystyle="true"`)
+	}
+	b.WriteString(">")
+	for _, row := range rows {
+		b.WriteString("<mtr>")
+		for _, cell := range row {
+			b.WriteString("<mtd>" + cell + "</mtd>")
+		}
+		b.WriteString("</mtr>")
+	}
+	b.WriteString("</mtable>")
+	table := b.String()
+	if env.open == "" && env.close == "" {
+		return mathNode{xml: table}
+	}
+	var fenced strings.Builder
+	fenced.WriteString("<mrow>")
+	if env.open != "" {
+		fenced.WriteString(`<mo fence="true" form="prefix" stretchy="true">` + env.open + "</mo>")
+	}
+	fenced.WriteString(table)
+	if env.close != "" {
+		fenced.WriteString(`<mo fence="true" form="postfix" stretchy="true">` + env.close + "</mo>")
+	}
+	fenced.WriteString("</mrow>")
+	return mathNode{xml: fenced.String()}
+}
+
+// mathStyle wraps a fraction from \dfrac or \tfrac in the style it asks
+// for.
+func mathStyle(command, xml string) string {
+	switch command[0] {
+	case 'd', 'c':
+		return `<mstyle displaystyle="true" scriptlevel="0">` + xml + "</mstyle>"
+	case 't':
+		return `<mstyle displaystyle="false" scriptlevel="0">` + xml + "</mstyle>"
+	}
+	return xml
+}
+
+// operator renders an operator. Brackets outside \left and \right keep
+// their size, as in TeX.
+func operator(s string) string {
+	if strings.ContainsAny(s, "()[]{}|‖⟨⟩⌊⌋⌈⌉/") {
+		return `<mo stretchy="false">` + html.EscapeString(s) + "</mo>"
+	}
+	return "<mo>" + html.EscapeString(s) + "</mo>"
+}
+
+// mrow renders a list of atoms as one MathML element.
+func mrow(nodes []mathNode) string {
+	if len(nodes) == 1 {
+		return nodes[0].xml
+	}
+	var b strings.Builder
+	b.WriteString("<mrow>")
+	for _, n := range nodes {
+		b.WriteString(n.xml)
+	}
+	b.WriteString("</mrow>")
+	return b.String()
+}
+
+func isDigit(c rune) bool { return c >= '0' && c <= '9' }
+
+func isASCIILetter(c rune) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+
+// mathFontStarts holds where each font's capitals, small letters and
+// digits start among the Unicode mathematical alphanumeric symbols.
+var mathFontStarts = map[string][3]rune{
+	"bf":   {0x1D400, 0x1D41A, 0x1D7CE},
+	"it":   {0x1D434, 0x1D44E, 0},
+	"bfit": {0x1D468, 0x1D482, 0x1D7CE},
+	"cal":  {0x1D49C, 0x1D4B6, 0},
+	"frak": {0x1D504, 0x1D51E, 0},
+	"bb":   {0x1D538, 0x1D552, 0x1D7D8},
+	"sf":   {0x1D5A0, 0x1D5BA, 0x1D7E2},
+	"tt":   {0x1D670, 0x1D68A, 0x1D7F6},
+}
+
+// mathFontHoles are the letters Unicode encoded before the mathematical
+// alphanumeric block, and left out of it.
+var mathFontHoles = map[string]map[rune]rune{
+	"it":   {'h': 'ℎ'},
+	"cal":  {'B': 'ℬ', 'E': 'ℰ', 'F': 'ℱ', 'H': 'ℋ', 'I': 'ℐ', 'L': 'ℒ', 'M': 'ℳ', 'R': 'ℛ', 'e': 'ℯ', 'g': 'ℊ', 'o': 'ℴ'},
+	"frak": {'C': 'ℭ', 'H': 'ℌ', 'I': 'ℑ', 'R': 'ℜ', 'Z': 'ℨ'},
+	"bb":   {'C': 'ℂ', 'H': 'ℍ', 'N': 'ℕ', 'P': 'ℙ', 'Q': 'ℚ', 'R': 'ℝ', 'Z': 'ℤ'},
+}
+
+// mathFont returns c in font, such as 𝐱 for an x in \mathbf. Characters
+// the font doesn't cover are returned as they are.
+func mathFont(c rune, font string) string {
+	starts, ok := mathFontStarts[font]
+	if !ok {
+		return string(c)
+	}
+	if r, ok := mathFontHoles[font][c]; ok {
+		return string(r)
+	}
+	switch {
+	case c >= 'A' && c <= 'Z':
+		return string(starts[0] + c - 'A')
+	case c >= 'a' && c <= 'z':
+		return string(starts[1] + c - 'a')
+	case c >= '0' && c <= '9' && starts[2] != 0:
+		return string(starts[2] + c - '0')
+	}
+	return string(c)
+}
+
+var mathFonts = map[string]string{
+	"mathbf": "bf", "mathit": "it", "mathrm": "rm", "mathcal": "cal", "mathscr": "cal",
+	"mathfrak": "frak", "mathbb": "bb", "mathsf": "sf", "mathtt": "tt",
+	"boldsymbol": "bfit", "bm": "bfit", "mathnormal": "",
+}
+
+// textSpaces keeps the spaces in \text, which MathML would otherwise trim.
+var textSpaces = strings.NewReplacer(" ", "\u00a0", "~", "\u00a0")
+
+var mathTextCommands = map[string]string{
+	"text": "", "textrm": "", "textnormal": "", "mbox": "", "textup": "",
+	"textbf": "bold", "textit": "italic", "textsf": "sans-serif", "texttt": "monospace",
+}
+
+var mathSpaces = map[string]string{
+	",": "0.1667em", "thinspace": "0.1667em",
+	":": "0.2222em", ">": "0.2222em", "medspace": "0.2222em",
+	";": "0.2778em", "thickspace": "0.2778em",
+	"!": "-0.1667em", "negthinspace": "-0.1667em",
+	" ": "0.25em", "quad": "1em", "qquad": "2em",
+}
+
+var mathIdentifiers = map[string]string{
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ϵ", "varepsilon": "ε",
+	"zeta": "ζ", "eta": "η", "theta": "θ", "vartheta": "ϑ", "iota": "ι", "kappa": "κ",
+	"lambda": "λ", "mu": "μ", "nu": "ν", "xi": "ξ", "omicron": "ο", "pi": "π", "varpi": "ϖ",
+	"rho": "ρ", "varrho": "ϱ", "sigma": "σ", "varsigma": "ς", "tau": "τ", "upsilon": "υ",
+	"phi": "ϕ", "varphi": "φ", "chi": "χ", "psi": "ψ", "omega": "ω",
+	"infty": "∞", "partial": "∂", "nabla": "∇", "emptyset": "∅", "varnothing": "∅",
+	"ell": "ℓ", "hbar": "ℏ", "hslash": "ℏ", "Re": "ℜ", "Im": "ℑ", "aleph": "ℵ", "wp": "℘",
+	"imath": "ı", "jmath": "ȷ", "top": "⊤", "bot": "⊥", "triangle": "△", "square": "□",
+	"Box": "□", "angle": "∠", "degree": "°", "dagger": "†", "ddagger": "‡",
+}
+
+// mathUprightIdentifiers are capital Greek letters, which TeX sets
+// upright.
+var mathUprightIdentifiers = map[string]string{
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ", "Pi": "Π",
+	"Sigma": "Σ", "Upsilon": "Υ", "Phi": "Φ", "Psi": "Ψ", "Omega": "Ω",
+}
+
+var mathOperators = map[string]string{
+	"times": "×", "cdot": "⋅", "pm": "±", "mp": "∓", "div": "÷", "ast": "∗", "star": "⋆",
+	"circ": "∘", "bullet": "∙", "oplus": "⊕", "ominus": "⊖", "otimes": "⊗", "odot": "⊙",
+	"cup": "∪", "cap": "∩", "setminus": "∖", "wedge": "∧", "land": "∧", "vee": "∨", "lor": "∨",
+	"neg": "¬", "lnot": "¬", "leq": "≤", "le": "≤", "geq": "≥", "ge": "≥", "leqslant": "⩽",
+	"geqslant": "⩾", "neq": "≠", "ne": "≠", "lt": "<", "gt": ">", "ll": "≪", "gg": "≫",
+	"approx": "≈", "equiv": "≡", "sim": "∼", "simeq": "≃", "cong": "≅", "propto": "∝",
+	"coloneqq": "≔", "in": "∈", "notin": "∉", "ni": "∋", "subset": "⊂", "subseteq": "⊆",
+	"supset": "⊃", "supseteq": "⊇", "mid": "∣", "parallel": "∥", "perp": "⊥",
+	"models": "⊨", "vdash": "⊢", "to": "→", "rightarrow": "→", "leftarrow": "←",
+	"gets": "←", "Rightarrow": "⇒", "Leftarrow": "⇐", "leftrightarrow": "↔",
+	"Leftrightarrow": "⇔", "longrightarrow": "⟶", "longleftarrow": "⟵",
+	"Longrightarrow": "⟹", "implies": "⟹", "Longleftarrow": "⟸", "impliedby": "⟸",
+	"iff": "⟺", "mapsto": "↦", "uparrow": "↑", "downarrow": "↓", "forall": "∀",
+	"exists": "∃", "nexists": "∄", "colon": ":", "ldots": "…", "dots": "…", "cdots": "⋯",
+	"vdots": "⋮", "ddots": "⋱", "prime": "′", "langle": "⟨", "rangle": "⟩", "lfloor": "⌊",
+	"rfloor": "⌋", "lceil": "⌈", "rceil": "⌉", "vert": "|", "lvert": "|", "rvert": "|",
+	"Vert": "‖", "lVert": "‖", "rVert": "‖", "|": "‖", "{": "{", "}": "}", "backslash": "\\",
+	"%": "%", "#": "#", "&": "&", "$": "$", "_": "_",
+}
+
+var mathDelimiters = map[string]string{
+	"langle": "⟨", "rangle": "⟩", "lfloor": "⌊", "rfloor": "⌋", "lceil": "⌈", "rceil": "⌉",
+	"vert": "|", "lvert": "|", "rvert": "|", "Vert": "‖", "lVert": "‖", "rVert": "‖",
+	"|": "‖", "{": "{", "}": "}", "lbrace": "{", "rbrace": "}", "lbrack": "[", "rbrack": "]",
+	"uparrow": "↑", "downarrow": "↓", "updownarrow": "↕", "backslash": "\\",
+}
+
+var mathBigDelimiters = map[string]string{
+	"big": "1.2em", "Big": "1.8em", "bigg": "2.4em", "Bigg": "3em",
+}
+
+var mathBigOperators = map[string]string{
+	"sum": "∑", "prod": "∏", "coprod": "∐", "bigcup": "⋃", "bigcap": "⋂", "bigvee": "⋁",
+	"bigwedge": "⋀", "bigoplus": "⨁", "bigotimes": "⨂", "bigodot": "⨀", "biguplus": "⨄",
+	"bigsqcup": "⨆",
+}
+
+// mathIntegrals are big operators whose limits stay at the side, even in
+// display math.
+var mathIntegrals = map[string]string{
+	"int": "∫", "iint": "∬", "iiint": "∭", "oint": "∮",
+}
+
+var mathFunctions = map[string]string{
+	"arccos": "arccos", "arcsin": "arcsin", "arctan": "arctan", "arg": "arg", "cos": "cos",
+	"cosh": "cosh", "cot": "cot", "coth": "coth", "csc": "csc", "deg": "deg", "dim": "dim",
+	"exp": "exp", "hom": "hom", "ker": "ker", "lg": "lg", "ln": "ln", "log": "log",
+	"sec": "sec", "sin": "sin", "sinh": "sinh", "tan": "tan", "tanh": "tanh",
+}
+
+// mathLimitFunctions are function names that take limits below them in
+// display math, as in \lim_{x \to 0}.
+var mathLimitFunctions = map[string]string{
+	"det": "det", "gcd": "gcd", "inf": "inf", "lim": "lim", "liminf": "lim inf",
+	"limsup": "lim sup", "max": "max", "min": "min", "Pr": "Pr", "sup": "sup",
+	"argmax": "arg max", "argmin": "arg min",
+}
+
+var mathAccents = map[string]string{
+	"hat": "^", "widehat": "^", "check": "ˇ", "tilde": "~", "widetilde": "~", "bar": "‾",
+	"vec": "→", "overrightarrow": "→", "overleftarrow": "←", "dot": "˙", "ddot": "¨",
+	"acute": "´", "grave": "`", "breve": "˘",
+}
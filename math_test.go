@@ -0,0 +1,52 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTexToMathML(t *testing.T) {
+	for _, tt := range []struct {
+		tex, want string
+		errs      []string
+	}{
+		{`x^2`, `<msup><mi>x</mi><mn>2</mn></msup>`, nil},
+		{`x_i^2`, `<msubsup><mi>x</mi><mi>i</mi><mn>2</mn></msubsup>`, nil},
+		{`12.5`, `<mn>12.5</mn>`, nil},
+		{`\alpha + 1`, `<mrow><mi>α</mi><mo>+</mo><mn>1</mn></mrow>`, nil},
+		{`\frac{a}{b}`, `<mfrac><mi>a</mi><mi>b</mi></mfrac>`, nil},
+		{`\sqrt{x}`, `<msqrt><mi>x</mi></msqrt>`, nil},
+		{`\mathbb{R}`, `<mi>ℝ</mi>`, nil},
+		{`\left( x \right)`, `<mrow><mo fence="true" form="prefix" stretchy="true">(</mo><mi>x</mi><mo fence="true" form="postfix" stretchy="true">)</mo></mrow>`, nil},
+		{`\begin{pmatrix} a & b \\ c & d \end{pmatrix}`, `<mrow><mo fence="true" form="prefix" stretchy="true">(</mo><mtable>` +
+			`<mtr><mtd><mi>a</mi></mtd><mtd><mi>b</mi></mtd></mtr><mtr><mtd><mi>c</mi></mtd><mtd><mi>d</mi></mtd></mtr>` +
+			`</mtable><mo fence="true" form="postfix" stretchy="true">)</mo></mrow>`, nil},
+		{`\frac{1}{`, `<mfrac><mn>1</mn><mrow></mrow></mfrac>`, []string{"missing }"}},
+		{`\color{red} x`, `<mrow><merror><mtext>\color</mtext></merror><mrow><mi>r</mi><mi>e</mi><mi>d</mi></mrow><mi>x</mi></mrow>`, []string{`unsupported command \color`}},
+	} {
+		got, errs := texToMathML(tt.tex, false)
+		body := strings.TrimPrefix(got, "<math><semantics>")
+		body, annotation, _ := strings.Cut(body, "<annotation")
+		if body != tt.want {
+			t.Errorf("texToMathML(%q) = %s, want %s", tt.tex, body, tt.want)
+		}
+		if !strings.HasPrefix(annotation, ` encoding="application/x-tex">`) || !strings.HasSuffix(got, "</annotation></semantics></math>") {
+			t.Errorf("texToMathML(%q) = %s, want the TeX kept as an annotation", tt.tex, got)
+		}
+		if !slices.Equal(errs, tt.errs) {
+			t.Errorf("texToMathML(%q) problems = %q, want %q", tt.tex, errs, tt.errs)
+		}
+	}
+}
+
+func TestTexToMathMLDisplay(t *testing.T) {
+	got, _ := texToMathML(" a < b & c ", true)
+	want := `<math display="block"><semantics><mrow><mi>a</mi><mo>&lt;</mo><mi>b</mi>`
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("got %s, want it to start %s", got, want)
+	}
+	if !strings.Contains(got, `<annotation encoding="application/x-tex">a &lt; b &amp; c</annotation>`) {
+		t.Errorf("got %s, want the trimmed, escaped TeX as its annotation", got)
+	}
+}
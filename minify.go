@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+	"golang.org/x/net/html"
+)
+
+// blockTags are the elements whitespace around which never renders, so it
+// can be dropped instead of collapsed.
+var blockTags = map[string]bool{
+	"html": true, "head": true, "body": true, "title": true, "meta": true, "link": true,
+	"style": true, "script": true, "noscript": true, "base": true, "template": true,
+	"address": true, "article": true, "aside": true, "blockquote": true, "br": true,
+	"details": true, "dialog": true, "dd": true, "div": true, "dl": true, "dt": true,
+	"fieldset": true, "figcaption": true, "figure": true, "footer": true, "form": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hgroup": true, "hr": true, "li": true, "main": true, "menu": true,
+	"nav": true, "ol": true, "option": true, "p": true, "pre": true, "section": true,
+	"summary": true, "table": true, "caption": true, "colgroup": true, "col": true,
+	"thead": true, "tbody": true, "tfoot": true, "tr": true, "td": true, "th": true,
+	"ul": true, "source": true, "track": true,
+}
+
+// pClosers are the start tags that implicitly close an open <p>.
+var pClosers = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "details": true,
+	"div": true, "dl": true, "fieldset": true, "figcaption": true, "figure": true,
+	"footer": true, "form": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "header": true, "hgroup": true, "hr": true, "main": true,
+	"menu": true, "nav": true, "ol": true, "p": true, "pre": true, "section": true,
+	"table": true, "ul": true,
+}
+
+// optionalEnd lists, for each element whose end tag may be omitted, the
+// tags that may directly follow it when it is: start tags as "name", end
+// tags of the parent as "/name", and the end of the document as "".
+var optionalEnd = map[string][]string{
+	"li":     {"li", "/ul", "/ol", "/menu"},
+	"dt":     {"dt", "dd"},
+	"dd":     {"dt", "dd", "/dl"},
+	"option": {"option", "optgroup", "/select", "/optgroup", "/datalist"},
+	"tr":     {"tr", "/tbody", "/thead", "/tfoot", "/table"},
+	"td":     {"td", "th", "/tr"},
+	"th":     {"td", "th", "/tr"},
+	"thead":  {"tbody", "tfoot"},
+	"tbody":  {"tbody", "tfoot", "/table"},
+	"tfoot":  {"/table"},
+	"p": {"/div", "/section", "/article", "/main", "/aside", "/header", "/footer",
+		"/nav", "/li", "/td", "/th", "/dd", "/blockquote", "/figure", "/figcaption",
+		"/details", "/body", "/form"},
+	"head": {"body"},
+	"body": {"/html", ""},
+	"html": {""},
+}
+
+type minifyToken struct {
+	typ  html.TokenType
+	name string
+	raw  string
+}
+
+// minifyHTML collapses whitespace, strips comments, drops optional end tags
+// and minifies <style> blocks. Whitespace inside <pre>, <textarea> and
+// <code>, and <script> contents, are left exactly as written.
+func minifyHTML(src []byte) []byte {
+	var tokens []minifyToken
+	z := html.NewTokenizer(bytes.NewReader(src))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		raw := string(z.Raw())
+		var name string
+		if tt == html.StartTagToken || tt == html.EndTagToken || tt == html.SelfClosingTagToken {
+			n, _ := z.TagName()
+			name = string(n)
+		}
+		tokens = append(tokens, minifyToken{typ: tt, name: name, raw: raw})
+	}
+
+	// Text next to a block-level tag (or the doctype) loses its edge spaces.
+	isBlock := func(t minifyToken) bool {
+		return (t.typ != html.TextToken && t.typ != html.CommentToken) && (t.typ == html.DoctypeToken || blockTags[t.name])
+	}
+	var out strings.Builder
+	out.Grow(len(src))
+	preserve := 0 // depth of <pre>, <textarea> and <code>
+	var last minifyToken
+	for i, t := range tokens {
+		switch t.typ {
+		case html.CommentToken:
+			if preserve > 0 || strings.HasPrefix(t.raw, "<!--[if") {
+				out.WriteString(t.raw)
+			}
+			continue
+		case html.TextToken:
+			switch {
+			case preserve > 0 || last.name == "script" && last.typ == html.StartTagToken:
+				out.WriteString(t.raw)
+			case last.name == "style" && last.typ == html.StartTagToken:
+				out.WriteString(minifyCSS(t.raw))
+			default:
+				text := collapseSpace(t.raw)
+				if last.typ == 0 || isBlock(last) {
+					text = strings.TrimLeft(text, " ")
+				}
+				if next := nextToken(tokens, i); next == nil || isBlock(*next) {
+					text = strings.TrimRight(text, " ")
+				}
+				out.WriteString(text)
+			}
+		case html.EndTagToken:
+			if preserve > 0 {
+				if t.name == "pre" || t.name == "textarea" || t.name == "code" {
+					preserve--
+				}
+				out.WriteString(t.raw)
+				break
+			}
+			if canOmitEnd(t.name, nextToken(tokens, i)) {
+				break
+			}
+			out.WriteString(collapseTag(t.raw))
+		case html.StartTagToken:
+			if t.name == "pre" || t.name == "textarea" || t.name == "code" {
+				if preserve == 0 {
+					out.WriteString(collapseTag(t.raw))
+				} else {
+					out.WriteString(t.raw)
+				}
+				preserve++
+				break
+			}
+			fallthrough
+		default:
+			if preserve > 0 {
+				out.WriteString(t.raw)
+			} else {
+				out.WriteString(collapseTag(t.raw))
+			}
+		}
+		last = t
+	}
+	return []byte(out.String())
+}
+
+// nextToken returns the first token after i that isn't a comment or
+// whitespace-only text, or nil at the end of the document.
+func nextToken(tokens []minifyToken, i int) *minifyToken {
+	for j := i + 1; j < len(tokens); j++ {
+		t := tokens[j]
+		if t.typ == html.CommentToken || t.typ == html.TextToken && strings.TrimSpace(t.raw) == "" {
+			continue
+		}
+		return &tokens[j]
+	}
+	return nil
+}
+
+// canOmitEnd reports whether the end tag of name may be dropped when next
+// follows it.
+func canOmitEnd(name string, next *minifyToken) bool {
+	follows, ok := optionalEnd[name]
+	if !ok {
+		return false
+	}
+	key := ""
+	switch {
+	case next == nil:
+	case next.typ == html.StartTagToken || next.typ == html.SelfClosingTagToken:
+		key = next.name
+		if name == "p" && pClosers[key] {
+			return true
+		}
+	case next.typ == html.EndTagToken:
+		key = "/" + next.name
+	default:
+		return false
+	}
+	for _, f := range follows {
+		if f == key {
+			return true
+		}
+	}
+	return false
+}
+
+// collapseSpace replaces every run of HTML whitespace with a single space.
+func collapseSpace(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s))
+	space := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case ' ', '\t', '\n', '\r', '\f':
+			space = true
+		default:
+			if space {
+				sb.WriteByte(' ')
+				space = false
+			}
+			sb.WriteByte(s[i])
+		}
+	}
+	if space {
+		sb.WriteByte(' ')
+	}
+	return sb.String()
+}
+
+// collapseTag collapses the whitespace between a tag's attributes, leaving
+// quoted values untouched.
+func collapseTag(raw string) string {
+	var sb strings.Builder
+	sb.Grow(len(raw))
+	var quote, prev byte
+	space := false
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if quote != 0 {
+			sb.WriteByte(c)
+			if c == quote {
+				quote = 0
+			}
+			prev = c
+			continue
+		}
+		switch c {
+		case ' ', '\t', '\n', '\r', '\f':
+			space = true
+			continue
+		case '"', '\'':
+			quote = c
+		}
+		// Keep one space between attributes, none around = or before the
+		// end of the tag. An unquoted value needs the space before "/>".
+		selfClose := c == '/' && i+1 < len(raw) && raw[i+1] == '>' && (prev == '"' || prev == '\'')
+		if space && c != '>' && c != '=' && prev != '=' && !selfClose {
+			sb.WriteByte(' ')
+		}
+		space = false
+		sb.WriteByte(c)
+		prev = c
+	}
+	return sb.String()
+}
+
+// minifyCSS minifies a stylesheet, returning it unchanged if esbuild can't
+// parse it.
+func minifyCSS(css string) string {
+	result := api.Transform(css, api.TransformOptions{
+		Loader:           api.LoaderCSS,
+		MinifyWhitespace: true,
+		MinifySyntax:     true,
+		LogLevel:         api.LogLevelSilent,
+	})
+	if len(result.Errors) > 0 {
+		return css
+	}
+	return strings.TrimSpace(string(result.Code))
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestMinifyHTML(t *testing.T) {
+	for _, tt := range []struct {
+		name, in, want string
+	}{
+		{"whitespace", "<div>\n  <p>a   b\n  c</p>\n</div>\n", "<div><p>a b c</div>"},
+		{"inline spaces kept", "<p>a <em>b</em> c</p>\n", "<p>a <em>b</em> c</p>"},
+		{"comments", "<p>a<!-- note -->b</p><!--[if IE]>x<![endif]-->", "<p>ab</p><!--[if IE]>x<![endif]-->"},
+		{"pre", "<pre>  a\n\n  b  </pre>", "<pre>  a\n\n  b  </pre>"},
+		{"code", "<p><code>a   b</code>  c</p>", "<p><code>a   b</code> c</p>"},
+		{"script", "<script>\n  let a =  1;\n</script>", "<script>\n  let a =  1;\n</script>"},
+		{"style", "<style>\n  p { color: red; }\n</style>", "<style>p{color:red}</style>"},
+		{"attributes", "<a  href=\"/a  b\"\n  class='x'>x</a>", "<a href=\"/a  b\" class='x'>x</a>"},
+		{"list items", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>", "<ul><li>a<li>b</ul>"},
+		{"p before block", "<p>a</p><div>b</div>", "<p>a<div>b</div>"},
+		{"p before inline", "<p>a</p><span>b</span>", "<p>a</p><span>b</span>"},
+		{"table", "<table><tr><td>a</td><td>b</td></tr></table>", "<table><tr><td>a<td>b</table>"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(minifyHTML([]byte(tt.in))); got != tt.want {
+				t.Errorf("minifyHTML(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMinifyCSS(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"p {\n  color: red;\n}\n", "p{color:red}"},
+		{"a { margin: 0px 0px; }\n/* note */", "a{margin:0}"},
+		{"@media (min-width: 40em) {\n  .a { color: #ff0000 }\n}", "@media (min-width: 40em){.a{color:red}}"},
+	} {
+		if got := minifyCSS(tt.in); got != tt.want {
+			t.Errorf("minifyCSS(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const pagesDir = "pages"
+
+// page is a single source file and the route it is built to.
+type page struct {
+	src   string // source path relative to the site dir, slash-separated
+	route string // URL path of the built page, always ending in "/"
+}
+
+// outputDir returns the directory, relative to the output root, that holds
+// the page's index.html and index.md.
+func (p page) outputDir() string {
+	return filepath.FromSlash(strings.Trim(p.route, "/"))
+}
+
+// discoverPages finds every page in the site: pager.html at the root, any
+// *.pager.html file, and every .html file under pages/. The output
+// directory is skipped when it lies inside the site, as are components/ and
+// partials/, whose files are only ever pulled into other pages.
+func discoverPages(dir, outDir string) ([]page, error) {
+	var pages []page
+	routes := make(map[string]string)
+
+	add := func(src, route string) error {
+		if prev, ok := routes[route]; ok {
+			return fmt.Errorf("%s and %s both build to %s", prev, src, route)
+		}
+		routes[route] = src
+		pages = append(pages, page{src: src, route: route})
+		return nil
+	}
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if p != dir && (strings.HasPrefix(d.Name(), ".") || d.Name() == "node_modules" || filepath.Clean(p) == outDir) {
+				return filepath.SkipDir
+			}
+			if rel == componentsDir || rel == partialsDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case strings.HasPrefix(rel, pagesDir+"/"):
+			if path.Ext(rel) != ".html" {
+				return nil
+			}
+			name := strings.TrimSuffix(strings.TrimPrefix(rel, pagesDir+"/"), ".html")
+			if path.Base(name) == "index" {
+				name = path.Dir(name)
+			}
+			return add(rel, routeFor(name))
+		case path.Base(rel) == "pager.html":
+			return add(rel, routeFor(path.Dir(rel)))
+		case strings.HasSuffix(rel, ".pager.html"):
+			return add(rel, routeFor(strings.TrimSuffix(rel, ".pager.html")))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("pager.html: %w", os.ErrNotExist)
+	}
+
+	sort.Slice(pages, func(i, j int) bool { return pages[i].route < pages[j].route })
+	return pages, nil
+}
+
+func routeFor(name string) string {
+	name = strings.Trim(name, "/")
+	if name == "" || name == "." {
+		return "/"
+	}
+	return "/" + name + "/"
+}
+
+// splitFrontMatter separates a leading YAML block delimited by "---" lines
+// from the rest of the file. It returns a nil front matter when there is none.
+func splitFrontMatter(data []byte) (front, body []byte) {
+	if !bytes.HasPrefix(data, []byte("---\n")) && !bytes.HasPrefix(data, []byte("---\r\n")) {
+		return nil, data
+	}
+	rest := data[bytes.IndexByte(data, '\n')+1:]
+	for offset := 0; offset < len(rest); {
+		end := bytes.IndexByte(rest[offset:], '\n')
+		line := rest[offset:]
+		if end >= 0 {
+			line = rest[offset : offset+end]
+		}
+		if string(bytes.TrimRight(line, "\r")) == "---" {
+			front = rest[:offset]
+			if end < 0 {
+				return front, nil
+			}
+			return front, rest[offset+end+1:]
+		}
+		if end < 0 {
+			break
+		}
+		offset += end + 1
+	}
+	return nil, data
+}
+
+// loadPageConfig decodes pager.yaml and then applies the page's front matter
+// on top, so every page starts from a fresh copy of the shared defaults.
+func loadPageConfig(raw, front []byte, src string) (Config, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return cfg, fmt.Errorf("pager.yaml: %w", err)
+	}
+	if len(front) > 0 {
+		if err := yaml.Unmarshal(front, &cfg); err != nil {
+			return cfg, fmt.Errorf("%s: front matter: %w", src, err)
+		}
+	}
+	return cfg, nil
+}
+
+// resolveRoute resolves a reference found on the page at route into a
+// site-absolute URL path, dropping any query string or fragment.
+func resolveRoute(route, ref string) (string, string, bool) {
+	base := &url.URL{Path: route}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", "", false
+	}
+	resolved := base.ResolveReference(u)
+	return resolved.Path, resolved.Fragment, true
+}
+
+// pageForPath returns the page that serves the given URL path, accepting
+// the route with or without its trailing slash or an explicit index.html.
+func pageForPath(pages map[string]*pageBuild, p string) *pageBuild {
+	p = strings.TrimSuffix(p, "index.html")
+	if !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return pages[p]
+}
@@ -3,22 +3,16 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"image"
-	_ "image/gif"
-	_ "image/jpeg"
-	_ "image/png"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"unicode"
 
-	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
-	"github.com/yuin/goldmark"
-	highlighting "github.com/yuin/goldmark-highlighting/v2"
-	"github.com/yuin/goldmark/extension"
-	gmhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/parser"
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
 )
@@ -70,6 +64,17 @@ func setAttr(n *html.Node, key, val string) {
 	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
 }
 
+// appendStyle adds a declaration to the element's style attribute.
+func appendStyle(n *html.Node, style string) {
+	for i, a := range n.Attr {
+		if a.Key == "style" {
+			n.Attr[i].Val = a.Val + "; " + style
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: "style", Val: style})
+}
+
 func getAttr(n *html.Node, key string) string {
 	for _, a := range n.Attr {
 		if a.Key == key {
@@ -81,9 +86,76 @@ func getAttr(n *html.Node, key string) string {
 
 type processState struct {
 	dir      string
+	route    string
+	src      string
+	diags    *diagnostics
+	pos      position // source position of the element being processed
+	ignored  []map[string]bool
 	headings []heading
 	ids      map[string]bool
-	links    []string
+	links    []linkRef
+	external []linkRef
+	assets   assetSet // files the page loads, hashed with hash_assets
+	linked   assetSet // files the page links to, which keep their names
+
+	images     *imagePipeline
+	imageCount int
+	manifest   *assetManifest // nil unless hash_assets is on
+	components map[string]*component
+	markdown   MarkdownConfig
+	front      map[string]any // front matter of the converted Markdown files; the first to set a key wins
+}
+
+// linkRef is a link collected for checking once every page is processed.
+type linkRef struct {
+	href   string
+	report reporter
+}
+
+func newProcessState(dir string, p page, diags *diagnostics) *processState {
+	return &processState{
+		dir:    dir,
+		route:  p.route,
+		src:    p.src,
+		diags:  diags,
+		pos:    position{File: p.src},
+		ids:    make(map[string]bool),
+		assets: make(assetSet),
+		linked: make(assetSet),
+		front:  make(map[string]any),
+	}
+}
+
+// report records a diagnostic at the element currently being processed.
+func (s *processState) report(rule, format string, args ...any) {
+	s.reporter()(rule, format, args...)
+}
+
+// reporter returns a reporter bound to the current element, which keeps
+// honoring the pager-ignore comments in effect here when called later.
+func (s *processState) reporter() reporter {
+	return s.reporterAt(s.pos, s.ignored)
+}
+
+// tagReporter returns a reporter for a tag expanded before the page is
+// parsed, at the tag's position and honoring the pager-ignore comments
+// ignoredByTag found around it.
+func (s *processState) tagReporter(attrs map[string]string, ignored map[string][]map[string]bool) reporter {
+	pos, _ := parsePos(attrs[posAttr])
+	return s.reporterAt(pos, ignored[attrs[posAttr]])
+}
+
+// reporterAt returns a reporter at pos that skips the rules ignored names.
+func (s *processState) reporterAt(pos position, ignored []map[string]bool) reporter {
+	ignored = append([]map[string]bool(nil), ignored...)
+	return func(rule, format string, args ...any) {
+		for _, rules := range ignored {
+			if rules[rule] || rules["*"] {
+				return
+			}
+		}
+		s.diags.report(rule, pos, format, args...)
+	}
 }
 
 func (s *processState) uniqueID(id string) string {
@@ -100,7 +172,23 @@ func (s *processState) uniqueID(id string) string {
 	}
 }
 
+// localPath maps a reference made on the current page to a file in the site
+// dir, resolving relative references against the page's route.
+func (s *processState) localPath(ref string) string {
+	p, _, ok := resolveRoute(s.route, ref)
+	if !ok {
+		return filepath.Join(s.dir, ref)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(p))
+}
+
 func processNode(n *html.Node, s *processState) {
+	if pos, ok := takePos(n); ok {
+		parentPos := s.pos
+		s.pos = pos
+		defer func() { s.pos = parentPos }()
+	}
+
 	if n.Type == html.ElementNode {
 		// Auto-ID headings based on text content
 		if len(n.Data) == 2 && n.Data[0] == 'h' && n.Data[1] >= '1' && n.Data[1] <= '6' {
@@ -130,31 +218,39 @@ func processNode(n *html.Node, s *processState) {
 
 		// Add aspect-ratio to images and warn on missing alt
 		if n.Data == "img" {
+			s.imageCount++
 			if !hasAttr(n, "alt") {
 				src := getAttr(n, "src")
-				warn("<img src=%q> missing alt text", src)
+				s.report("img-alt", "<img src=%q> missing alt text", src)
 			}
 			src := getAttr(n, "src")
 			if src != "" && !strings.HasPrefix(src, "http") {
-				imgPath := filepath.Join(s.dir, src)
-				if f, err := os.Open(imgPath); err == nil {
-					if cfg, _, err := image.DecodeConfig(f); err == nil {
-						style := fmt.Sprintf("aspect-ratio: %d / %d", cfg.Width, cfg.Height)
-						found := false
-						for i, a := range n.Attr {
-							if a.Key == "style" {
-								n.Attr[i].Val = a.Val + "; " + style
-								found = true
-								break
-							}
-						}
-						if !found {
-							n.Attr = append(n.Attr, html.Attribute{Key: "style", Val: style})
-						}
-					}
-					f.Close()
+				imgPath := s.localPath(src)
+				if width, height, ok := imageSize(imgPath); ok {
+					appendStyle(n, fmt.Sprintf("aspect-ratio: %d / %d", width, height))
+					s.sizeImage(n, src, width, height)
+					s.placeholder(n, imgPath)
 				}
 			}
+			s.lazyLoad(n)
+		}
+
+		// Size <picture> sources from their first candidate, so art-directed
+		// sources with a different shape reserve the right space too
+		if n.Data == "source" && n.Parent != nil && n.Parent.Data == "picture" && !hasAttr(n, "width") && !hasAttr(n, "height") {
+			if urls := srcsetURLs(getAttr(n, "srcset")); len(urls) > 0 && isLocalRef(urls[0]) {
+				if width, height, ok := imageSize(s.localPath(urls[0])); ok {
+					setAttr(n, "width", strconv.Itoa(width))
+					setAttr(n, "height", strconv.Itoa(height))
+				}
+			}
+		}
+
+		// Give videos the aspect-ratio of their poster
+		if n.Data == "video" && isLocalRef(getAttr(n, "poster")) && !hasAttr(n, "width") && !hasAttr(n, "height") {
+			if width, height, ok := imageSize(s.localPath(getAttr(n, "poster"))); ok {
+				appendStyle(n, fmt.Sprintf("aspect-ratio: %d / %d", width, height))
+			}
 		}
 
 		// Warn on empty or missing-file src/poster attributes
@@ -162,40 +258,98 @@ func processNode(n *html.Node, s *processState) {
 			if hasAttr(n, attr) {
 				val := getAttr(n, attr)
 				if val == "" {
-					warn("<%s> has empty %s attribute", n.Data, attr)
+					s.report("attr-empty", "<%s> has empty %s attribute", n.Data, attr)
 				} else if !strings.HasPrefix(val, "http") && !strings.HasPrefix(val, "data:") && !strings.HasPrefix(val, "//") {
-					path := filepath.Join(s.dir, val)
-					if _, err := os.Stat(path); err != nil {
-						warn("<%s %s=%q> references missing file", n.Data, attr, val)
+					if _, err := os.Stat(s.localPath(val)); err != nil {
+						s.report("file-missing", "<%s %s=%q> references missing file", n.Data, attr, val)
+					} else if loadsRef(n, attr) {
+						s.assets.add(s.dir, s.route, val)
+					} else {
+						s.linked.add(s.dir, s.route, val)
 					}
 				}
 			}
 		}
 
+		// Collect the remaining files the page pulls in, local or external
+		var refs []string
+		for _, attr := range []string{"src", "poster"} {
+			if isExternalURL(getAttr(n, attr)) {
+				refs = append(refs, getAttr(n, attr))
+			}
+		}
+		if href := getAttr(n, "href"); n.Data == "link" {
+			if isExternalURL(href) || loadsRef(n, "href") {
+				refs = append(refs, href)
+			} else {
+				s.linked.add(s.dir, s.route, href)
+			}
+		}
+		if hasAttr(n, "srcset") {
+			refs = append(refs, srcsetURLs(getAttr(n, "srcset"))...)
+		}
+		if hasAttr(n, "style") {
+			refs = append(refs, cssReferences(getAttr(n, "style"))...)
+		}
+		for _, ref := range refs {
+			if isExternalURL(ref) {
+				s.external = append(s.external, linkRef{href: ref, report: s.reporter()})
+			} else {
+				s.assets.add(s.dir, s.route, ref)
+			}
+		}
+
 		// Validate links and collect local links for later checks.
 		if n.Data == "a" {
 			href := getAttr(n, "href")
 			if strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") {
 				if u, err := url.Parse(href); err != nil {
-					warn("<a href=%q> is not a valid URL", href)
+					s.report("link-url", "<a href=%q> is not a valid URL", href)
 				} else if strings.Contains(u.Host, "localhost") || strings.Contains(u.Host, "127.0.0.1") {
-					warn("<a href=%q> links to localhost", href)
+					s.report("link-localhost", "<a href=%q> links to localhost", href)
+				} else {
+					s.external = append(s.external, linkRef{href: href, report: s.reporter()})
 				}
 			} else if href == "" {
-				warn("<a> has empty href attribute")
+				s.report("attr-empty", "<a> has empty href attribute")
 			} else {
-				s.links = append(s.links, href)
+				s.links = append(s.links, linkRef{href: href, report: s.reporter()})
 			}
 			// Warn on icon-only links missing aria-label
 			text := strings.TrimSpace(textContent(n))
 			if text == "" && !hasAttr(n, "aria-label") {
-				warn("<a href=%q> has no text and no aria-label", href)
+				s.report("link-text", "<a href=%q> has no text and no aria-label", href)
 			}
 		}
+
+		s.hashRefs(n)
 	}
 
+	var children []*html.Node
 	for c := n.FirstChild; c != nil; c = c.NextSibling {
-		processNode(c, s)
+		children = append(children, c)
+	}
+	processSiblings(children, s)
+}
+
+// processSiblings processes a run of sibling nodes. A <!-- pager-ignore -->
+// comment silences the rules it names for the element that follows it.
+func processSiblings(nodes []*html.Node, s *processState) {
+	var pending map[string]bool
+	for _, n := range nodes {
+		switch {
+		case n.Type == html.CommentNode:
+			if ignored, ok := ignoredRules(n.Data); ok {
+				pending = ignored
+			}
+		case n.Type == html.ElementNode && pending != nil:
+			s.ignored = append(s.ignored, pending)
+			processNode(n, s)
+			s.ignored = s.ignored[:len(s.ignored)-1]
+			pending = nil
+			continue
+		}
+		processNode(n, s)
 	}
 }
 
@@ -257,74 +411,144 @@ func buildTOC(headings []heading) string {
 	return sb.String()
 }
 
-func processContent(content string, dir string) string {
-	md := goldmark.New(goldmark.WithExtensions(
-		extension.GFM,
-		extension.Typographer,
-		highlighting.NewHighlighting(
-			highlighting.WithFormatOptions(
-				chromahtml.WithClasses(true),
-				chromahtml.PreventSurroundingPre(false),
-			),
-		),
-	), goldmark.WithRendererOptions(
-		gmhtml.WithUnsafe(),
-	))
+// tagAttrs parses the attributes of a single start tag such as a <convert>
+// or <syntax> match.
+func tagAttrs(tag string) map[string]string {
+	attrs := make(map[string]string)
+	z := html.NewTokenizer(strings.NewReader(tag))
+	if tt := z.Next(); tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+		return attrs
+	}
+	_, more := z.TagName()
+	for more {
+		var key, val []byte
+		key, val, more = z.TagAttr()
+		attrs[string(key)] = string(val)
+	}
+	return attrs
+}
+
+// processContent expands, parses and processes a page's HTML, recording its
+// headings, ids, links and assets in s. content must already carry source
+// positions from annotatePositions.
+func processContent(content string, s *processState) string {
+	dir := s.dir
+	md := newMarkdown(s.markdown)
+
+	content = s.expandIncludes(content, s.src, []string{s.src})
 
 	// Expand <convert src="..."> tags: .md → HTML, .csv → table
-	convertRe := regexp.MustCompile(`<convert\s+src="([^"]*)"\s*/?>(?:</convert>)?`)
-	content = convertRe.ReplaceAllStringFunc(content, func(match string) string {
-		m := convertRe.FindStringSubmatch(match)
-		src := m[1]
+	ignored := ignoredByTag(content)
+	content = convertTagRe.ReplaceAllStringFunc(content, func(match string) string {
+		attrs := tagAttrs(match)
+		report := s.tagReporter(attrs, ignored)
+		src := attrs["src"]
 		if src == "" {
-			warn("<convert> has empty src attribute")
+			report("attr-empty", "<convert> has empty src attribute")
 			return ""
 		}
 		filePath := filepath.Join(dir, src)
 		data, err := os.ReadFile(filePath)
 		if err != nil {
-			warn("<convert src=%q> references missing file", src)
+			report("file-missing", "<convert src=%q> references missing file", src)
 			return ""
 		}
 		ext := strings.ToLower(filepath.Ext(src))
 		switch ext {
 		case ".md":
+			// Front matter goes to .Front; only the prose is converted.
+			front, body := splitFrontMatter(data)
+			keys, pos, err := markdownFrontMatter(src, front)
+			if err != nil {
+				// Reported in the Markdown file, but a pager-ignore on the
+				// <convert> tag still covers it.
+				s.reporterAt(pos, ignored[attrs[posAttr]])("convert", "front matter: %v", err)
+			}
+			mergeFront(s.front, keys)
+			ctx := parser.NewContext()
+			ctx.Set(mdFileKey, strings.TrimPrefix(filepath.ToSlash(src), "/"))
+			ctx.Set(mdLineOffsetKey, bytes.Count(data[:len(data)-len(body)], []byte("\n")))
 			var buf bytes.Buffer
-			if err := md.Convert(data, &buf); err != nil {
-				warn("<convert src=%q> failed to convert markdown: %v", src, err)
+			if err := md.Convert(body, &buf, parser.WithContext(ctx)); err != nil {
+				report("convert", "<convert src=%q> failed to convert markdown: %v", src, err)
 				return ""
 			}
 			return buf.String()
 		case ".csv":
-			return csvToTable(data, src)
+			return csvToTable(data, src, report)
 		default:
-			warn("<convert src=%q> unsupported extension %q (use .md or .csv)", src, ext)
+			report("convert", "<convert src=%q> unsupported extension %q (use .md or .csv)", src, ext)
 			return ""
 		}
 	})
 
 	// Expand <syntax src="..."> tags: syntax-highlighted code block
-	syntaxRe := regexp.MustCompile(`<syntax\s+src="([^"]*)"\s*/?>(?:</syntax>)?`)
+	syntaxRe := regexp.MustCompile(`<syntax\b(?:[^>"']|"[^"]*"|'[^']*')*/?>(?:</syntax>)?`)
+	ignored = ignoredByTag(content)
 	content = syntaxRe.ReplaceAllStringFunc(content, func(match string) string {
-		m := syntaxRe.FindStringSubmatch(match)
-		src := m[1]
+		attrs := tagAttrs(match)
+		report := s.tagReporter(attrs, ignored)
+		src := attrs["src"]
 		if src == "" {
-			warn("<syntax> has empty src attribute")
+			report("attr-empty", "<syntax> has empty src attribute")
 			return ""
 		}
 		filePath := filepath.Join(dir, src)
 		data, err := os.ReadFile(filePath)
 		if err != nil {
-			warn("<syntax src=%q> references missing file", src)
+			report("file-missing", "<syntax src=%q> references missing file", src)
 			return ""
 		}
-		return highlightCode(data, src)
+		lines := syntaxLines(data)
+		opts := parseSyntaxOptions(attrs, len(lines), report)
+		code, numbers := opts.selectLines(data, lines, src, report)
+		return highlightCode(code, src, numbers, opts, report)
+	})
+
+	// Expand <diagram src="..."> tags and ```diagram fences: ASCII art →
+	// inline SVG
+	diagramSrcRe := regexp.MustCompile(`<diagram\b[^>]*\bsrc\s*=[^>]*?/?>(?:\s*</diagram\s*>)?`)
+	ignored = ignoredByTag(content)
+	content = diagramSrcRe.ReplaceAllStringFunc(content, func(match string) string {
+		attrs := tagAttrs(match)
+		report := s.tagReporter(attrs, ignored)
+		src := attrs["src"]
+		if src == "" {
+			report("attr-empty", "<diagram> has empty src attribute")
+			return ""
+		}
+		data, err := os.ReadFile(filepath.Join(dir, src))
+		if err != nil {
+			report("file-missing", "<diagram src=%q> references missing file", src)
+			return ""
+		}
+		return diagramSVG(string(data), attrs["alt"])
+	})
+	diagramRe := regexp.MustCompile(`(?s)<diagram\b[^>]*>(.*?)</diagram\s*>`)
+	content = diagramRe.ReplaceAllStringFunc(content, func(match string) string {
+		attrs := tagAttrs(match)
+		return diagramSVG(html.UnescapeString(diagramRe.FindStringSubmatch(match)[1]), attrs["alt"])
+	})
+
+	// Expand <math-tex> tags, including the ones from converted Markdown:
+	// TeX → MathML
+	mathRe := regexp.MustCompile(`(?s)<math-tex\b[^>]*>(.*?)</math-tex\s*>`)
+	ignored = ignoredByTag(content)
+	content = mathRe.ReplaceAllStringFunc(content, func(match string) string {
+		attrs := tagAttrs(match)
+		report := s.tagReporter(attrs, ignored)
+		tex := strings.TrimSpace(html.UnescapeString(mathRe.FindStringSubmatch(match)[1]))
+		mathML, problems := texToMathML(tex, attrs["display"] == "block")
+		for _, problem := range problems {
+			report("math", "%s in $%s$", problem, tex)
+		}
+		return mathML
 	})
 
 	// Replace <toc /> and <toc></toc> with a placeholder before parsing
 	hasTOC := false
 	const tocPlaceholder = "<!--TOC_PLACEHOLDER-->"
-	tocRe := regexp.MustCompile(`<toc\s*/>|<toc>\s*</toc>`)
+	tocRe := regexp.MustCompile(`<toc\b[^>]*/>|<toc\b[^>]*>\s*</toc>`)
 	if tocRe.MatchString(content) {
 		content = tocRe.ReplaceAllString(content, tocPlaceholder)
 		hasTOC = true
@@ -335,29 +559,23 @@ func processContent(content string, dir string) string {
 		Data:     "body",
 		DataAtom: atom.Body,
 	}
-	nodes, err := html.ParseFragment(strings.NewReader(content), context)
+	ignored = ignoredByTag(content)
+	nodes, err := html.ParseFragment(strings.NewReader(closeComponentTags(content)), context)
 	if err != nil {
 		return content
 	}
-	s := &processState{dir: dir, ids: make(map[string]bool)}
+	// Expand x-* components in place, so their output is processed like
+	// the rest of the page.
 	for _, n := range nodes {
-		processNode(n, s)
+		context.AppendChild(n)
 	}
-
-	// Validate local links
-	for _, link := range s.links {
-		if strings.HasPrefix(link, "#") {
-			id := link[1:]
-			if !s.ids[id] {
-				warn("<a href=%q> references missing id", link)
-			}
-		} else if !strings.HasPrefix(link, "http") && !strings.HasPrefix(link, "mailto:") && !strings.HasPrefix(link, "tel:") {
-			path := filepath.Join(dir, link)
-			if _, err := os.Stat(path); err != nil {
-				warn("<a href=%q> references missing file", link)
-			}
-		}
+	s.expandComponents(context, nil, ignored)
+	nodes = nodes[:0]
+	for n := context.FirstChild; n != nil; n = context.FirstChild {
+		context.RemoveChild(n)
+		nodes = append(nodes, n)
 	}
+	processSiblings(nodes, s)
 
 	var buf bytes.Buffer
 	for _, n := range nodes {
@@ -377,3 +595,94 @@ func processContent(content string, dir string) string {
 
 	return result
 }
+
+// processInject records the local files the inject: snippet uses, so they
+// are copied to the output too, and points the ones it loads at their
+// hashed names. Tags that don't change are kept exactly as written.
+func (s *processState) processInject(inject string) string {
+	var sb strings.Builder
+	inStyle := false
+	z := html.NewTokenizer(strings.NewReader(inject))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return sb.String()
+		}
+		raw := string(z.Raw())
+		switch tt {
+		case html.TextToken:
+			if inStyle {
+				for _, ref := range cssReferences(raw) {
+					s.assets.add(s.dir, s.route, ref)
+				}
+				raw = s.manifest.rewriteCSS(s.route, raw)
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			inStyle = tok.Data == "style" && tt == html.StartTagToken
+			n := &html.Node{Type: html.ElementNode, Data: tok.Data, Attr: slices.Clone(tok.Attr)}
+			for _, a := range n.Attr {
+				switch {
+				case a.Key == "style":
+					for _, ref := range cssReferences(a.Val) {
+						s.assets.add(s.dir, s.route, ref)
+					}
+				case a.Key == "srcset":
+					for _, ref := range srcsetURLs(a.Val) {
+						s.assets.add(s.dir, s.route, ref)
+					}
+				case a.Key == "src" || a.Key == "poster" || a.Key == "href":
+					if loadsRef(n, a.Key) {
+						s.assets.add(s.dir, s.route, a.Val)
+					} else {
+						s.linked.add(s.dir, s.route, a.Val)
+					}
+				}
+			}
+			s.hashRefs(n)
+			if !slices.Equal(n.Attr, tok.Attr) {
+				tok.Attr = n.Attr
+				raw = tok.String()
+			}
+		case html.EndTagToken:
+			inStyle = false
+		}
+		sb.WriteString(raw)
+	}
+}
+
+// checkLinks validates the local links collected from a page. Links to other
+// pages in the site resolve against their routes, including #fragments.
+func checkLinks(pb *pageBuild, pages map[string]*pageBuild) {
+	s := pb.state
+	for _, link := range s.links {
+		href := link.href
+		report := link.report
+		if strings.HasPrefix(href, "#") {
+			id := href[1:]
+			if !s.ids[id] {
+				report("link-anchor", "<a href=%q> references missing id", href)
+			}
+			continue
+		}
+		if strings.HasPrefix(href, "http") || strings.HasPrefix(href, "mailto:") || strings.HasPrefix(href, "tel:") {
+			continue
+		}
+		p, fragment, ok := resolveRoute(s.route, href)
+		if !ok {
+			report("link-url", "<a href=%q> is not a valid URL", href)
+			continue
+		}
+		if target := pageForPath(pages, p); target != nil {
+			if fragment != "" && !target.state.ids[fragment] {
+				report("link-anchor", "<a href=%q> references missing id on %s", href, target.route)
+			}
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(s.dir, filepath.FromSlash(p))); err != nil {
+			report("link-file", "<a href=%q> references missing file", href)
+		} else {
+			s.linked.add(s.dir, s.route, href)
+		}
+	}
+}
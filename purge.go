@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// selectorSet holds the tag names, classes and ids used on a page, for
+// deciding which CSS rules could possibly match it.
+type selectorSet struct {
+	tags     map[string]bool
+	classes  map[string]bool
+	ids      map[string]bool
+	safelist map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// templateActionRe matches a {{ }} action in a page template.
+var templateActionRe = regexp.MustCompile(`(?s)\{\{.*?\}\}`)
+
+// pageSelectors collects the selectors used by the rendered content, plus
+// the elements the page template always adds and, for a custom template:,
+// the ones in layout, its source. Safelist entries are class names or ids
+// kept regardless, or /regular expressions/ matched against them.
+func pageSelectors(content, layout string, safelist []string, report reporter) *selectorSet {
+	set := &selectorSet{
+		tags:     map[string]bool{"html": true, "head": true, "body": true, "title": true, "meta": true, "link": true, "style": true, "script": true},
+		classes:  make(map[string]bool),
+		ids:      make(map[string]bool),
+		safelist: make(map[string]bool),
+	}
+	for _, entry := range safelist {
+		if len(entry) > 1 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/") {
+			re, err := regexp.Compile(entry[1 : len(entry)-1])
+			if err != nil {
+				report("purge-css", "invalid purge_safelist pattern %s: %v", entry, err)
+				continue
+			}
+			set.patterns = append(set.patterns, re)
+			continue
+		}
+		set.safelist[strings.TrimLeft(entry, ".#")] = true
+	}
+
+	nodes, err := html.ParseFragment(strings.NewReader(content), &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body})
+	if err != nil {
+		return set
+	}
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			set.tags[strings.ToLower(n.Data)] = true
+			for _, class := range strings.Fields(getAttr(n, "class")) {
+				set.classes[class] = true
+			}
+			if id := getAttr(n, "id"); id != "" {
+				set.ids[id] = true
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	for _, n := range nodes {
+		walk(n)
+	}
+	// The layout is parsed as a whole document, so the classes on its
+	// <html> and <body> count too. Classes set by actions can't be known,
+	// but ones inside {{ if }} blocks can.
+	if layout != "" {
+		if doc, err := html.Parse(strings.NewReader(templateActionRe.ReplaceAllString(layout, " "))); err == nil {
+			walk(doc)
+		}
+	}
+	return set
+}
+
+func (set *selectorSet) safe(name string) bool {
+	if set.safelist[name] {
+		return true
+	}
+	for _, re := range set.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// canMatch reports whether sel, a single complex selector, could match an
+// element on the page. It only rules selectors out when they need a tag,
+// class or id the page doesn't have; anything inside :not(), :is() and
+// other functional pseudo-classes, and attribute selectors, are assumed to
+// match.
+func (set *selectorSet) canMatch(sel string) bool {
+	sel = stripSelectorGroups(sel)
+	compoundStart := true
+	for i := 0; i < len(sel); {
+		c := sel[i]
+		switch {
+		case c == '&':
+			return true
+		case c == '.' || c == '#':
+			name, n := readIdent(sel[i+1:])
+			i += 1 + n
+			if name == "" || set.safe(name) {
+				continue
+			}
+			if c == '.' && !set.classes[name] || c == '#' && !set.ids[name] {
+				return false
+			}
+			compoundStart = false
+		case c == ':':
+			for i < len(sel) && sel[i] == ':' {
+				i++
+			}
+			_, n := readIdent(sel[i:])
+			i += n
+			compoundStart = false
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '>' || c == '+' || c == '~':
+			i++
+			compoundStart = true
+		case compoundStart && isIdentStart(c):
+			name, n := readIdent(sel[i:])
+			i += n
+			if i < len(sel) && sel[i] == '|' {
+				// A namespace prefix, not a tag name.
+				i++
+				continue
+			}
+			if !set.tags[strings.ToLower(name)] {
+				return false
+			}
+			compoundStart = false
+		default:
+			i++
+			compoundStart = false
+		}
+	}
+	return true
+}
+
+// stripSelectorGroups removes the contents of (), [] and quoted strings,
+// which never make a selector require anything of the page.
+func stripSelectorGroups(sel string) string {
+	var sb strings.Builder
+	depth := 0
+	var quote byte
+	for i := 0; i < len(sel); i++ {
+		c := sel[i]
+		switch {
+		case c == '\\' && i+1 < len(sel):
+			if depth == 0 && quote == 0 {
+				sb.WriteByte(c)
+				sb.WriteByte(sel[i+1])
+			}
+			i++
+			continue
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+			continue
+		case c == '"' || c == '\'':
+			quote = c
+			continue
+		case c == '(' || c == '[':
+			depth++
+			continue
+		case c == ')' || c == ']':
+			if depth > 0 {
+				depth--
+			}
+			continue
+		}
+		if depth == 0 {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+func isIdentStart(c byte) bool {
+	return c == '-' || c == '_' || c == '\\' || c >= 0x80 || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// readIdent reads a CSS identifier from the start of s, resolving escapes
+// such as the \: in Tailwind's md\:flex. It returns the identifier and the
+// number of bytes consumed.
+func readIdent(s string) (string, int) {
+	var sb strings.Builder
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			j := i + 1
+			for j < len(s) && j < i+7 && isHex(s[j]) {
+				j++
+			}
+			if j > i+1 {
+				var r rune
+				fmt.Sscanf(s[i+1:j], "%x", &r)
+				sb.WriteRune(r)
+				if j < len(s) && s[j] == ' ' {
+					j++
+				}
+				i = j
+				continue
+			}
+			sb.WriteByte(s[i+1])
+			i += 2
+		case isIdentStart(c) || c >= '0' && c <= '9':
+			sb.WriteByte(c)
+			i++
+		default:
+			return sb.String(), i
+		}
+	}
+	return sb.String(), i
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// conditionalAtRules hold ordinary rules, which are purged in turn. Every
+// other at-rule, like @font-face or @keyframes, is kept whole.
+var conditionalAtRules = map[string]bool{
+	"@media": true, "@supports": true, "@layer": true, "@container": true, "@scope": true, "@document": true,
+}
+
+// purgeCSS drops the rules in css whose selectors can't match any element
+// in set, and conditional at-rules left empty as a result.
+func purgeCSS(css string, set *selectorSet) string {
+	var out strings.Builder
+	for i := 0; i < len(css); {
+		end, _ := scanCSS(css, i, "{;}")
+		if end >= len(css) {
+			out.WriteString(css[i:])
+			break
+		}
+		if css[end] != '{' {
+			out.WriteString(css[i : end+1])
+			i = end + 1
+			continue
+		}
+		closeAt := matchingBrace(css, end)
+		if closeAt >= len(css) {
+			out.WriteString(css[i:])
+			break
+		}
+		prelude, body := css[i:end], css[end+1:closeAt]
+		next := closeAt + 1
+
+		trimmed := strings.TrimSpace(stripCSSComments(prelude))
+		if strings.HasPrefix(trimmed, "@") {
+			name := strings.ToLower(strings.FieldsFunc(trimmed, func(r rune) bool { return r == ' ' || r == '(' || r == '\n' || r == '\t' })[0])
+			if conditionalAtRules[name] {
+				inner := purgeCSS(body, set)
+				if strings.TrimSpace(stripCSSComments(inner)) != "" {
+					out.WriteString(prelude + "{" + inner + "}")
+				}
+			} else {
+				out.WriteString(css[i:next])
+			}
+			i = next
+			continue
+		}
+
+		var kept []string
+		selectors := splitSelectors(trimmed)
+		for _, sel := range selectors {
+			if set.canMatch(sel) {
+				kept = append(kept, sel)
+			}
+		}
+		switch {
+		case len(kept) == len(selectors):
+			out.WriteString(css[i:next])
+		case len(kept) > 0:
+			out.WriteString(leadingSpace(prelude) + strings.Join(kept, ", ") + " {" + body + "}")
+		}
+		i = next
+	}
+	return out.String()
+}
+
+// scanCSS returns the index of the first byte in stops at or after i that
+// isn't inside a comment, string or parentheses, or len(css) if none is.
+func scanCSS(css string, i int, stops string) (int, bool) {
+	depth := 0
+	for i < len(css) {
+		c := css[i]
+		switch {
+		case c == '/' && i+1 < len(css) && css[i+1] == '*':
+			if end := strings.Index(css[i+2:], "*/"); end >= 0 {
+				i += end + 4
+			} else {
+				i = len(css)
+			}
+			continue
+		case c == '"' || c == '\'':
+			i++
+			for i < len(css) && css[i] != c {
+				if css[i] == '\\' {
+					i++
+				}
+				i++
+			}
+		case c == '\\':
+			i++
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth > 0 {
+				depth--
+			}
+		case depth == 0 && strings.IndexByte(stops, c) >= 0:
+			return i, true
+		}
+		i++
+	}
+	return len(css), false
+}
+
+// matchingBrace returns the index of the } closing the { at open, or the
+// end of css if it is never closed.
+func matchingBrace(css string, open int) int {
+	depth := 0
+	for i := open; i < len(css); {
+		end, ok := scanCSS(css, i, "{}")
+		if !ok {
+			return len(css)
+		}
+		if css[end] == '{' {
+			depth++
+		} else if depth--; depth == 0 {
+			return end
+		}
+		i = end + 1
+	}
+	return len(css)
+}
+
+// splitSelectors splits a selector list on its top-level commas.
+func splitSelectors(list string) []string {
+	var selectors []string
+	for i := 0; ; {
+		end, ok := scanCSS(list, i, ",")
+		if sel := strings.TrimSpace(list[i:end]); sel != "" {
+			selectors = append(selectors, sel)
+		}
+		if !ok {
+			return selectors
+		}
+		i = end + 1
+	}
+}
+
+func stripCSSComments(css string) string {
+	for {
+		start := strings.Index(css, "/*")
+		if start < 0 {
+			return css
+		}
+		end := strings.Index(css[start+2:], "*/")
+		if end < 0 {
+			return css[:start]
+		}
+		css = css[:start] + css[start+2+end+2:]
+	}
+}
+
+func leadingSpace(s string) string {
+	return s[:len(s)-len(strings.TrimLeft(s, " \t\r\n\f"))]
+}
+
+// purgedStylesheet returns the stylesheet file for a purged copy of the
+// local stylesheet rel, named after its content hash, once per build.
+func (site *siteBuild) purgedStylesheet(rel string, code []byte) *bundleFile {
+	hash := fmt.Sprintf("%x", sha256.Sum256(code))[:8]
+	out := hashedName(strings.TrimPrefix(rel, "/"), hash)
+	if b, ok := site.styles[out]; ok {
+		return b
+	}
+	b := &bundleFile{code: code, out: out, url: "/" + out}
+	site.styles[out] = b
+	return b
+}
+
+func formatBytes(n int) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f kB", float64(n)/1024)
+}
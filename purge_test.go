@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func testSelectors(t *testing.T, content string, safelist ...string) *selectorSet {
+	t.Helper()
+	return pageSelectors(content, "", safelist, func(rule, format string, args ...any) {
+		t.Errorf("unexpected report %s", rule)
+	})
+}
+
+func TestReadIdent(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+		n        int
+	}{
+		{"card.x", "card", 4},
+		{"md\\:flex:hover", "md:flex", 8},
+		{"w-1\\/2 p", "w-1/2", 6},
+		{"\\31 0 x", "10", 5},
+		{"_a-b9)", "_a-b9", 5},
+		{":x", "", 0},
+	} {
+		if got, n := readIdent(tt.in); got != tt.want || n != tt.n {
+			t.Errorf("readIdent(%q) = %q, %d, want %q, %d", tt.in, got, n, tt.want, tt.n)
+		}
+	}
+}
+
+func TestCanMatch(t *testing.T) {
+	set := testSelectors(t, `<div class="card md:flex" id="top"><p>x</p></div>`, "is-open", "/^js-/")
+	for _, tt := range []struct {
+		sel  string
+		want bool
+	}{
+		{"p", true},
+		{"table", false},
+		{".card > p", true},
+		{".card .missing", false},
+		{"#top", true},
+		{"#bottom", false},
+		{".md\\:flex", true},
+		{"div.is-open", true},
+		{".js-menu", true},
+		{"a:hover", false},
+		{"p::first-line", true},
+		{"div:not(.missing)", true},
+		{"[data-x] p", true},
+		{"svg|p", true},
+		{"svg|a", false},
+		{"&.nested", true},
+		{"*", true},
+	} {
+		if got := set.canMatch(tt.sel); got != tt.want {
+			t.Errorf("canMatch(%q) = %v, want %v", tt.sel, got, tt.want)
+		}
+	}
+}
+
+func TestPurgeCSS(t *testing.T) {
+	set := testSelectors(t, `<p class="lead">x</p>`)
+	for _, tt := range []struct {
+		name, in, want string
+	}{
+		{"unused rule", "p { a: 1 }\n.gone { b: 2 }\n", "p { a: 1 }\n"},
+		{"selector list", "h1, .lead { a: 1 }", ".lead { a: 1 }"},
+		{"empty media", "@media (x) { .gone { a: 1 } }", ""},
+		{"kept media", "@media (x) { .gone { a: 1 } p { b: 2 } }", "@media (x) { p { b: 2 } }"},
+		{"other at-rules", "@font-face { font-family: x }\n@import url(a.css);", "@font-face { font-family: x }\n@import url(a.css);"},
+		{"braces in strings", ".lead::after { content: \"}\" }\n.gone { a: 1 }", ".lead::after { content: \"}\" }"},
+		{"comments", "/* .lead { */ .gone { a: 1 }", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := purgeCSS(tt.in, set); got != tt.want {
+				t.Errorf("purgeCSS(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
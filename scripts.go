@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// bundleJS bundles a local js: entry once per build and returns nil if it
+// failed. Problems are reported at their position in the script sources.
+func (site *siteBuild) bundleJS(entry string, minify bool, report reporter, diags *diagnostics) *bundleFile {
+	rel := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(entry)), "/")
+	key := fmt.Sprintf("%s|%t", rel, minify)
+	if b, ok := site.scripts[key]; ok {
+		return b
+	}
+	site.scripts[key] = nil
+
+	absDir, err := filepath.Abs(site.dir)
+	if err != nil {
+		report("js-build", "%s: %v", entry, err)
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(absDir, filepath.FromSlash(rel))); err != nil {
+		report("file-missing", "script not found: %s", entry)
+		return nil
+	}
+	out := strings.TrimSuffix(rel, path.Ext(rel)) + ".js"
+	result := api.Build(api.BuildOptions{
+		EntryPoints:       []string{rel},
+		AbsWorkingDir:     absDir,
+		Outfile:           filepath.Join(absDir, filepath.FromSlash(out)),
+		Bundle:            true,
+		Write:             false,
+		Format:            api.FormatESModule,
+		Target:            api.ES2020,
+		MinifyWhitespace:  minify,
+		MinifyIdentifiers: minify,
+		MinifySyntax:      minify,
+		LogLevel:          api.LogLevelSilent,
+	})
+	for _, msg := range result.Errors {
+		reportESBuild(diags, report, "js-build", msg)
+	}
+	for _, msg := range result.Warnings {
+		reportESBuild(diags, report, "js-warning", msg)
+	}
+	if len(result.Errors) > 0 {
+		return nil
+	}
+
+	var code []byte
+	for _, f := range result.OutputFiles {
+		if strings.HasSuffix(f.Path, ".js") {
+			code = f.Contents
+		}
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256(code))[:8]
+	b := &bundleFile{code: code, out: out}
+	switch {
+	case site.manifest != nil:
+		b.out = hashedName(out, hash)
+		b.url = "/" + b.out
+	default:
+		// Built in place, the bundle sits among the sources, where main.js
+		// could be the entry itself or a hand-written sibling of main.ts.
+		if site.outDir == filepath.Clean(site.dir) {
+			b.out = strings.TrimSuffix(rel, path.Ext(rel)) + ".bundle.js"
+		}
+		b.url = fmt.Sprintf("/%s?v=%s", b.out, hash)
+	}
+	site.scripts[key] = b
+	return b
+}
@@ -65,13 +65,14 @@ func sseHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// fileServer serves static files but injects the livereload script into index.html in-memory.
+// fileServer serves static files but injects the livereload script into every page's index.html in-memory.
 func fileServer(dir string) http.Handler {
 	fs := http.FileServer(http.Dir(dir))
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		p := r.URL.Path
-		if p == "/" || p == "/index.html" {
-			data, err := os.ReadFile(filepath.Join(dir, "index.html"))
+		if strings.HasSuffix(p, "/") || strings.HasSuffix(p, "/index.html") {
+			page := strings.TrimSuffix(p, "index.html")
+			data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(page), "index.html"))
 			if err != nil {
 				fs.ServeHTTP(w, r)
 				return
@@ -170,13 +171,27 @@ func startTailwindWatcher(dir string) (string, <-chan struct{}, func()) {
 	return outPath, tailwindDone, cleanup
 }
 
-func run(dir string, port int) error {
+func run(dir string, port int, opts buildOptions) error {
 	tailwindOutputPath, tailwindDone, stopTailwindWatcher := startTailwindWatcher(dir)
 	defer stopTailwindWatcher()
+	opts.tailwindOutput = tailwindOutputPath
+	opts.dev = true
+	// Where the last build wrote, which the watcher must not react to. Each
+	// file it wrote is kept with the modification time the build left, so
+	// a later edit to one of them by hand still triggers a rebuild.
+	outDir := filepath.Clean(dir)
+	generated := make(map[string]time.Time)
 	runBuild := func(trigger string) error {
 		started := time.Now()
 		log.Printf("[perf] rebuild_start trigger=%s", trigger)
-		err := buildWithTailwindOutput(dir, tailwindOutputPath)
+		result, err := buildSite(dir, opts)
+		outDir = result.outDir
+		clear(generated)
+		for _, path := range result.written {
+			if info, err := os.Stat(path); err == nil {
+				generated[filepath.Clean(path)] = info.ModTime()
+			}
+		}
 		if err != nil {
 			log.Printf("[perf] rebuild_done trigger=%s status=error elapsed=%s", trigger, time.Since(started))
 			return err
@@ -204,6 +219,9 @@ func run(dir string, port int) error {
 			if strings.HasPrefix(filepath.Base(path), ".") && path != dir {
 				return filepath.SkipDir
 			}
+			if outDir != filepath.Clean(dir) && filepath.Clean(path) == outDir {
+				return filepath.SkipDir
+			}
 			watcher.Add(path)
 		}
 		return nil
@@ -213,8 +231,6 @@ func run(dir string, port int) error {
 		const fsDebounceDelay = 300 * time.Millisecond
 		const tailwindDebounceDelay = 50 * time.Millisecond
 		const relevantOps = fsnotify.Write | fsnotify.Create | fsnotify.Rename | fsnotify.Remove
-		const generatedHTML = "index.html"
-		const generatedMarkdown = "index.md"
 		timer := time.NewTimer(fsDebounceDelay)
 		if !timer.Stop() {
 			select {
@@ -250,8 +266,12 @@ func run(dir string, port int) error {
 				if event.Op&relevantOps == 0 {
 					continue
 				}
-				base := filepath.Base(event.Name)
-				if base == generatedHTML || base == generatedMarkdown {
+				if built, ok := generated[filepath.Clean(event.Name)]; ok {
+					if info, err := os.Stat(event.Name); err == nil && info.ModTime().Equal(built) {
+						continue
+					}
+				}
+				if outDir != filepath.Clean(dir) && isWithin(event.Name, outDir) {
 					continue
 				}
 				if event.Op&fsnotify.Create != 0 {
@@ -310,7 +330,7 @@ func run(dir string, port int) error {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/_reload", sseHandler)
-	mux.Handle("/", fileServer(dir))
+	mux.Handle("/", fileServer(outDir))
 
 	for attempts := 0; attempts < 50; attempts++ {
 		addr := fmt.Sprintf(":%d", port)
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	sriCacheFile = ".pager-cache/sri.json"
+	// sriRecheck is how long a pinned hash goes before the asset is
+	// downloaded again to see whether it changed.
+	sriRecheck = 24 * time.Hour
+)
+
+// assetLink is a stylesheet or script for the template to link, with its
+// Subresource Integrity hash when it has one.
+type assetLink struct {
+	URL       string
+	Integrity string
+	Module    bool // load the script as an ES module
+}
+
+// sriEntry is the pinned hash of one remote asset.
+type sriEntry struct {
+	Integrity string    `json:"integrity"`
+	CheckedAt time.Time `json:"checked_at"`
+	// Changed is the hash the asset had when last downloaded, if that no
+	// longer matches the pinned one.
+	Changed string `json:"changed,omitempty"`
+}
+
+// sriCache downloads remote stylesheets and scripts to hash them, and pins
+// the hashes in a cache file so each asset is only fetched again once a day.
+type sriCache struct {
+	path    string
+	client  *http.Client
+	entries map[string]sriEntry
+	checked map[string]bool // URLs already verified during this build
+	dirty   bool
+}
+
+// loadSRICache reads the pinned hashes, reporting a cache file that doesn't
+// parse and starting over without it.
+func loadSRICache(dir string, report reporter) *sriCache {
+	c := &sriCache{
+		path:    filepath.Join(dir, sriCacheFile),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		entries: make(map[string]sriEntry),
+		checked: make(map[string]bool),
+	}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return c
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		report("cache", "ignoring unreadable SRI cache: %v", err)
+		c.entries = make(map[string]sriEntry)
+	}
+	return c
+}
+
+func (c *sriCache) save() error {
+	if !c.dirty {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, data, 0644)
+}
+
+// integrity returns the pinned integrity value for url, downloading it if
+// it isn't pinned yet or is due a recheck. If the asset changed since it
+// was pinned, the old hash stays pinned, so browsers refuse the new file,
+// and a warning is reported on every build until the entry is removed from
+// the cache file to accept the change; --strict turns that into a failed
+// build.
+func (c *sriCache) integrity(url string, report reporter) string {
+	pinned, ok := c.entries[url]
+	if c.checked[url] {
+		return pinned.Integrity
+	}
+	c.checked[url] = true
+
+	if !ok || time.Since(pinned.CheckedAt) >= sriRecheck {
+		current, err := c.fetch(url)
+		switch {
+		case err != nil && !ok:
+			report("sri", "%s could not be downloaded for an integrity hash: %v", url, err)
+			return ""
+		case err != nil:
+			// Keep the pin and try again next build.
+		case !ok:
+			pinned = sriEntry{Integrity: current}
+		case current == pinned.Integrity:
+			pinned.Changed = ""
+		default:
+			pinned.Changed = current
+		}
+		if err == nil {
+			pinned.CheckedAt = time.Now()
+			c.entries[url] = pinned
+			c.dirty = true
+		}
+	}
+	if pinned.Changed != "" {
+		report("sri-changed", "%s changed since its hash was pinned (pinned %s, now %s); remove its entry from %s to accept the change",
+			url, pinned.Integrity, pinned.Changed, sriCacheFile)
+	}
+	return pinned.Integrity
+}
+
+func (c *sriCache) fetch(url string) (string, error) {
+	resp, err := c.client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	h := sha512.New384()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return "", err
+	}
+	return "sha384-" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
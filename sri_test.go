@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func sriHash(body string) string {
+	sum := sha512.Sum384([]byte(body))
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// sriServer serves body at every path but /missing.css, counting the
+// requests.
+type sriServer struct {
+	*httptest.Server
+	mu   sync.Mutex
+	body string
+	hits int
+}
+
+func newSRIServer(t *testing.T, body string) *sriServer {
+	srv := &sriServer{body: body}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		srv.hits++
+		if r.URL.Path == "/missing.css" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, srv.body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func testSRICache(t *testing.T, dir string, srv *sriServer) *sriCache {
+	c := loadSRICache(dir, func(rule, format string, args ...any) {
+		t.Errorf("unexpected report %s: %s", rule, fmt.Sprintf(format, args...))
+	})
+	c.client = srv.Client()
+	return c
+}
+
+func TestSRIPinsNewAsset(t *testing.T) {
+	const body = "body { color: red }"
+	srv := newSRIServer(t, body)
+	dir := t.TempDir()
+	url := srv.URL + "/style.css"
+
+	var r reports
+	c := testSRICache(t, dir, srv)
+	if got, want := c.integrity(url, r.reporter()), sriHash(body); got != want {
+		t.Errorf("integrity = %q, want %q", got, want)
+	}
+	if len(r.got) > 0 {
+		t.Errorf("got reports %q, want none", r.got)
+	}
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next build reads the pinned hash back without downloading.
+	c = testSRICache(t, dir, srv)
+	if got, want := c.integrity(url, r.reporter()), sriHash(body); got != want {
+		t.Errorf("cached integrity = %q, want %q", got, want)
+	}
+	if srv.hits != 1 {
+		t.Errorf("asset was downloaded %d times, want once", srv.hits)
+	}
+}
+
+func TestSRICachedHit(t *testing.T) {
+	srv := newSRIServer(t, "new")
+	url := srv.URL + "/app.js"
+
+	var r reports
+	c := testSRICache(t, t.TempDir(), srv)
+	c.entries[url] = sriEntry{Integrity: sriHash("old"), CheckedAt: time.Now().Add(-time.Hour)}
+	if got, want := c.integrity(url, r.reporter()), sriHash("old"); got != want {
+		t.Errorf("integrity = %q, want the pinned %q", got, want)
+	}
+	if srv.hits != 0 {
+		t.Errorf("asset pinned an hour ago was downloaded %d times", srv.hits)
+	}
+	if len(r.got) > 0 {
+		t.Errorf("got reports %q, want none", r.got)
+	}
+}
+
+func TestSRIChangedAsset(t *testing.T) {
+	srv := newSRIServer(t, "new")
+	dir := t.TempDir()
+	url := srv.URL + "/app.js"
+
+	var r reports
+	c := testSRICache(t, dir, srv)
+	c.entries[url] = sriEntry{Integrity: sriHash("old"), CheckedAt: time.Now().Add(-2 * sriRecheck)}
+	// The old hash stays pinned until the change is accepted, so browsers
+	// refuse what the CDN serves now.
+	if got, want := c.integrity(url, r.reporter()), sriHash("old"); got != want {
+		t.Errorf("integrity = %q, want the pinned %q", got, want)
+	}
+	if want := []string{"sri-changed"}; fmt.Sprint(r.rules()) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %v", r.got, want)
+	}
+	if got := c.entries[url]; got.Integrity != sriHash("old") || got.Changed != sriHash("new") {
+		t.Errorf("pinned %+v, want the old hash with the new one noted", got)
+	}
+
+	// Later pages in the same build aren't warned again.
+	var later reports
+	if got, want := c.integrity(url, later.reporter()), sriHash("old"); got != want || len(later.got) > 0 {
+		t.Errorf("second lookup = %q with %q, want %q and no reports", got, later.got, want)
+	}
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next build warns again without downloading.
+	var next reports
+	c = testSRICache(t, dir, srv)
+	if got, want := c.integrity(url, next.reporter()), sriHash("old"); got != want {
+		t.Errorf("next build integrity = %q, want the pinned %q", got, want)
+	}
+	if want := []string{"sri-changed"}; fmt.Sprint(next.rules()) != fmt.Sprint(want) {
+		t.Errorf("next build got %q, want %v", next.got, want)
+	}
+	if srv.hits != 1 {
+		t.Errorf("asset was downloaded %d times, want once", srv.hits)
+	}
+}
+
+func TestSRIFetchFails(t *testing.T) {
+	srv := newSRIServer(t, "")
+	url := srv.URL + "/missing.css"
+
+	var r reports
+	c := testSRICache(t, t.TempDir(), srv)
+	if got := c.integrity(url, r.reporter()); got != "" {
+		t.Errorf("integrity = %q, want none", got)
+	}
+	if want := []string{"sri"}; fmt.Sprint(r.rules()) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %v", r.got, want)
+	}
+	if _, ok := c.entries[url]; ok {
+		t.Errorf("failed download was pinned")
+	}
+
+	// A pinned hash outlives a failed recheck.
+	var recheck reports
+	c = testSRICache(t, t.TempDir(), srv)
+	c.entries[url] = sriEntry{Integrity: sriHash("old"), CheckedAt: time.Now().Add(-2 * sriRecheck)}
+	if got, want := c.integrity(url, recheck.reporter()), sriHash("old"); got != want {
+		t.Errorf("integrity = %q, want the pinned %q", got, want)
+	}
+	if len(recheck.got) > 0 {
+		t.Errorf("got reports %q, want none", recheck.got)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// bundleCSS bundles the local stylesheets in entries, in order, into one
+// minified stylesheet named after its content hash, once per build. Local
+// @imports are inlined and url()s are rebased to root-relative paths, so
+// they resolve from wherever the bundle ends up. It returns nil if bundling
+// failed.
+func (site *siteBuild) bundleCSS(entries []string, report reporter, diags *diagnostics) *bundleFile {
+	key := strings.Join(entries, "\n")
+	if b, ok := site.styles[key]; ok {
+		return b
+	}
+	site.styles[key] = nil
+
+	absDir, err := filepath.Abs(site.dir)
+	if err != nil {
+		report("css-bundle", "%v", err)
+		return nil
+	}
+	var entry strings.Builder
+	for _, css := range entries {
+		fmt.Fprintf(&entry, "@import %q;\n", "./"+strings.TrimPrefix(filepath.ToSlash(css), "/"))
+	}
+	result := api.Build(api.BuildOptions{
+		Stdin: &api.StdinOptions{
+			Contents:   entry.String(),
+			ResolveDir: absDir,
+			Sourcefile: "pager.yaml",
+			Loader:     api.LoaderCSS,
+		},
+		AbsWorkingDir:    absDir,
+		Outfile:          filepath.Join(absDir, "bundle.css"),
+		Bundle:           true,
+		Write:            false,
+		MinifyWhitespace: true,
+		MinifySyntax:     true,
+		LogLevel:         api.LogLevelSilent,
+		Plugins:          []api.Plugin{siteRootResolver(absDir)},
+	})
+	for _, msg := range result.Errors {
+		reportESBuild(diags, report, "css-bundle", msg)
+	}
+	if len(result.Errors) > 0 {
+		return nil
+	}
+
+	var code []byte
+	for _, f := range result.OutputFiles {
+		if strings.HasSuffix(f.Path, ".css") {
+			code = f.Contents
+		}
+	}
+	if site.manifest != nil {
+		code = []byte(site.manifest.rewriteCSS("/", string(code)))
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256(code))[:8]
+	b := &bundleFile{code: code, out: hashedName("bundle.css", hash)}
+	b.url = "/" + b.out
+	site.styles[key] = b
+	return b
+}
+
+// siteRootResolver resolves root-relative @imports against the site dir
+// and leaves every url() pointing where it did, rewritten relative to the
+// site root. Remote URLs are left alone.
+func siteRootResolver(absDir string) api.Plugin {
+	return api.Plugin{
+		Name: "pager-site-root",
+		Setup: func(build api.PluginBuild) {
+			build.OnResolve(api.OnResolveOptions{Filter: ".*"}, func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+				if !isLocalRef(args.Path) {
+					return api.OnResolveResult{Path: args.Path, External: true}, nil
+				}
+				switch args.Kind {
+				case api.ResolveCSSImportRule:
+					if strings.HasPrefix(args.Path, "/") {
+						return api.OnResolveResult{Path: filepath.Join(absDir, filepath.FromSlash(args.Path))}, nil
+					}
+				case api.ResolveCSSURLToken:
+					ref, suffix := args.Path, ""
+					if i := strings.IndexAny(ref, "?#"); i >= 0 {
+						ref, suffix = ref[:i], ref[i:]
+					}
+					abs := filepath.Join(args.ResolveDir, filepath.FromSlash(ref))
+					if strings.HasPrefix(ref, "/") {
+						abs = filepath.Join(absDir, filepath.FromSlash(ref))
+					}
+					rel, err := filepath.Rel(absDir, abs)
+					if err != nil || !isWithin(abs, absDir) {
+						return api.OnResolveResult{Path: args.Path, External: true}, nil
+					}
+					return api.OnResolveResult{Path: "/" + filepath.ToSlash(rel) + suffix, External: true}, nil
+				}
+				return api.OnResolveResult{}, nil
+			})
+		},
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// syntaxOptions are the attributes of a <syntax> tag besides src. Line
+// numbers always count from the top of the file, whatever slice of it is
+// shown.
+type syntaxOptions struct {
+	lines       [2]int   // first and last line to show, or zero for the whole file
+	region      string   // show the lines between region:name and endregion markers
+	highlight   [][2]int // line ranges to highlight
+	lineNumbers bool
+	lang        string // chroma lexer name, instead of going by the extension
+	title       string // header above the code, such as its file name
+	caption     string // caption below the code
+}
+
+// regionMarkerRe matches a line holding a region:name or endregion marker
+// in a comment, such as "// region:setup" or "# endregion".
+var regionMarkerRe = regexp.MustCompile(`^\s*(?://|#|--|;|/\*|<!--|%|')\s*(end)?region(?::([\w.-]+))?(?:\s|\*/|-->|$)`)
+
+// parseSyntaxOptions reads the options of a <syntax> tag for a file with
+// lineCount lines, reporting the ones it can't use.
+func parseSyntaxOptions(attrs map[string]string, lineCount int, report reporter) syntaxOptions {
+	src := attrs["src"]
+	opts := syntaxOptions{region: attrs["region"], lang: attrs["lang"], caption: attrs["caption"]}
+	_, opts.lineNumbers = attrs["linenos"]
+	if title, ok := attrs["title"]; ok {
+		// A bare title shows the file's own name.
+		if title == "" {
+			title = src
+		}
+		opts.title = title
+	}
+	if spec, ok := attrs["lines"]; ok {
+		ranges, err := parseLineRanges(spec, lineCount)
+		switch {
+		case err != nil:
+			report("syntax", "<syntax src=%q> lines=%q: %v", src, spec, err)
+		case len(ranges) != 1:
+			report("syntax", "<syntax src=%q> lines=%q must be a single range, like 10-40", src, spec)
+		case opts.region != "":
+			report("syntax", "<syntax src=%q> sets both lines and region; lines is ignored", src)
+		default:
+			opts.lines = ranges[0]
+		}
+	}
+	if spec, ok := attrs["highlight"]; ok {
+		ranges, err := parseLineRanges(spec, lineCount)
+		if err != nil {
+			report("syntax", "<syntax src=%q> highlight=%q: %v", src, spec, err)
+		}
+		opts.highlight = ranges
+	}
+	return opts
+}
+
+// parseLineRanges parses a list of line numbers and ranges such as
+// "12,15-18". A range with no end, like "20-", runs to the last line.
+func parseLineRanges(spec string, lineCount int) ([][2]int, error) {
+	var ranges [][2]int
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil || start < 1 {
+			return nil, fmt.Errorf("%q is not a line number or range", part)
+		}
+		end := start
+		if isRange {
+			end = lineCount
+			if last = strings.TrimSpace(last); last != "" {
+				if end, err = strconv.Atoi(last); err != nil || end < start {
+					return nil, fmt.Errorf("%q is not a line number or range", part)
+				}
+			}
+		}
+		if start > lineCount {
+			return nil, fmt.Errorf("line %d is past the end of the file (%d lines)", start, lineCount)
+		}
+		ranges = append(ranges, [2]int{start, min(end, lineCount)})
+	}
+	return ranges, nil
+}
+
+// syntaxLines splits a file into lines, without their line endings.
+func syntaxLines(data []byte) []string {
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
+// selectLines returns the part of a file a <syntax> tag shows, and the
+// line number in the file of each of its lines.
+func (opts syntaxOptions) selectLines(data []byte, lines []string, src string, report reporter) (string, []int) {
+	switch {
+	case opts.region != "":
+		return selectRegion(lines, opts.region, src, report)
+	case opts.lines != [2]int{}:
+		return strings.Join(lines[opts.lines[0]-1:opts.lines[1]], "\n") + "\n", lineNumbers(opts.lines[0], opts.lines[1])
+	}
+	return string(data), lineNumbers(1, len(lines))
+}
+
+func lineNumbers(first, last int) []int {
+	var numbers []int
+	for n := first; n <= last; n++ {
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
+
+// selectRegion returns the lines between the region:name marker and its
+// endregion, leaving out the markers of any regions nested inside it.
+// endregion closes the innermost open region; endregion:name closes name.
+func selectRegion(lines []string, name, src string, report reporter) (string, []int) {
+	var out []string
+	var numbers []int
+	inside := false
+	var open []string
+	for i, line := range lines {
+		m := regionMarkerRe.FindStringSubmatch(line)
+		if m == nil {
+			if inside {
+				out = append(out, line)
+				numbers = append(numbers, i+1)
+			}
+			continue
+		}
+		if m[1] == "" {
+			if !inside && m[2] == name {
+				inside = true
+			} else if inside {
+				open = append(open, m[2])
+			}
+			continue
+		}
+		if !inside {
+			continue
+		}
+		// An endregion for the selected region, or one left over once
+		// every nested region is closed, ends the selection.
+		if m[2] == name || (m[2] == "" && len(open) == 0) {
+			return strings.Join(out, "\n") + "\n", numbers
+		}
+		if m[2] == "" {
+			open = open[:len(open)-1]
+			continue
+		}
+		for j := len(open) - 1; j >= 0; j-- {
+			if open[j] == m[2] {
+				open = open[:j]
+				break
+			}
+		}
+	}
+	if !inside {
+		report("syntax", "<syntax src=%q> has no region:%s marker", src, name)
+		return "", nil
+	}
+	report("syntax", "<syntax src=%q> region %q has no endregion marker", src, name)
+	return strings.Join(out, "\n") + "\n", numbers
+}
+
+// highlighted reports whether line n of the file is in a highlight range.
+func (opts syntaxOptions) highlighted(n int) bool {
+	for _, r := range opts.highlight {
+		if n >= r[0] && n <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+var lineNumberRe = regexp.MustCompile(`<span class="ln">\s*\d+</span>`)
+
+// renumberLines replaces the line numbers chroma counted up from the first
+// line with the file's own, for regions that skip nested region markers.
+func renumberLines(code string, numbers []int) string {
+	if len(numbers) == 0 || numbers[len(numbers)-1]-numbers[0] == len(numbers)-1 {
+		return code
+	}
+	width := len(strconv.Itoa(numbers[len(numbers)-1]))
+	i := 0
+	return lineNumberRe.ReplaceAllStringFunc(code, func(match string) string {
+		if i >= len(numbers) {
+			return match
+		}
+		i++
+		return fmt.Sprintf(`<span class="ln">%*d</span>`, width, numbers[i-1])
+	})
+}
+
+// wrap puts highlighted code in a <figure> with its title and caption, if
+// it has either.
+func (opts syntaxOptions) wrap(code string) string {
+	if opts.title == "" && opts.caption == "" {
+		return code
+	}
+	var b strings.Builder
+	b.WriteString(`<figure class="syntax">`)
+	if opts.title != "" {
+		b.WriteString(`<div class="syntax-title">` + html.EscapeString(opts.title) + "</div>")
+	}
+	b.WriteString(code)
+	if opts.caption != "" {
+		b.WriteString("<figcaption>" + html.EscapeString(opts.caption) + "</figcaption>")
+	}
+	b.WriteString("</figure>")
+	return b.String()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseLineRanges(t *testing.T) {
+	for _, tt := range []struct {
+		spec string
+		want [][2]int
+		err  string
+	}{
+		{"3", [][2]int{{3, 3}}, ""},
+		{"12, 15-18", [][2]int{{12, 12}, {15, 18}}, ""},
+		{"18-", [][2]int{{18, 20}}, ""},
+		{"19-40", [][2]int{{19, 20}}, ""},
+		{"0", nil, `"0" is not a line number or range`},
+		{"5-2", nil, `"5-2" is not a line number or range`},
+		{"a-b", nil, `"a-b" is not a line number or range`},
+		{"", nil, `"" is not a line number or range`},
+		{"21", nil, "line 21 is past the end of the file (20 lines)"},
+	} {
+		got, err := parseLineRanges(tt.spec, 20)
+		var errText string
+		if err != nil {
+			errText = err.Error()
+		}
+		if errText != tt.err {
+			t.Errorf("parseLineRanges(%q) error = %q, want %q", tt.spec, errText, tt.err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseLineRanges(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestSelectRegion(t *testing.T) {
+	lines := syntaxLines([]byte(`package main
+
+// region:main
+func main() {
+	# region:setup
+	setup()
+	# endregion
+	// region:run
+	run()
+	// endregion:run
+}
+// endregion:main
+/* region:css */
+p {}
+/* endregion */
+<!-- region:open -->
+left open
+`))
+	for _, tt := range []struct {
+		name, want string
+		numbers    []int
+		rules      []string
+	}{
+		{"main", "func main() {\n\tsetup()\n\trun()\n}\n", []int{4, 6, 9, 11}, nil},
+		{"setup", "\tsetup()\n", []int{6}, nil},
+		{"run", "\trun()\n", []int{9}, nil},
+		{"css", "p {}\n", []int{14}, nil},
+		{"open", "left open\n", []int{17}, []string{"syntax"}},
+		{"missing", "", nil, []string{"syntax"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var r reports
+			got, numbers := selectRegion(lines, tt.name, "main.go", r.reporter())
+			if got != tt.want || !slices.Equal(numbers, tt.numbers) {
+				t.Errorf("got %q at %v, want %q at %v", got, numbers, tt.want, tt.numbers)
+			}
+			if !slices.Equal(r.rules(), tt.rules) {
+				t.Errorf("reported %q, want %v", r.got, tt.rules)
+			}
+		})
+	}
+}
+
+func TestRenumberLines(t *testing.T) {
+	code := `<span class="ln">1</span>a` + "\n" + `<span class="ln">2</span>b` + "\n" + `<span class="ln">3</span>c`
+	for _, tt := range []struct {
+		name    string
+		numbers []int
+		want    []string
+	}{
+		{"consecutive", []int{7, 8, 9}, []string{">1<", ">2<", ">3<"}},
+		{"gaps", []int{4, 6, 11}, []string{`"ln"> 4<`, `"ln"> 6<`, `"ln">11<`}},
+		{"none", nil, []string{">1<", ">2<", ">3<"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := renumberLines(code, tt.numbers)
+			for _, w := range tt.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("got %s, want it to contain %s", got, w)
+				}
+			}
+		})
+	}
+}